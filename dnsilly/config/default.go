@@ -24,8 +24,9 @@ func defaultConfig() *Config {
 		Reload:  10 * time.Second,
 		Rules:   "dnsilly.rules",
 		Server: &ConfigServer{
-			Host: "0.0.0.0",
-			Port: 53,
+			Host:      "0.0.0.0",
+			Port:      53,
+			Protocols: []string{"udp", "tcp"},
 		},
 		Upstreams: []*ConfigUpstream{
 			&ConfigUpstream{
@@ -0,0 +1,87 @@
+// dnsilly - dns automation utility
+// Copyright (C) 2025  bitrate16 (bitrate16@gmail.com)
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Parse config from given yaml
+func parseTestConfig(t *testing.T, data string) *Config {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "dnsilly.yml")
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	conf, err := ParseConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return conf
+}
+
+func TestParseConfigLimits(t *testing.T) {
+	tests := []struct {
+		name            string
+		data            string
+		maxEntries      int
+		maxObservations int
+	}{
+		{
+			name:            "default",
+			data:            "cache: {}\nstate: {}\n",
+			maxEntries:      10000,
+			maxObservations: 10000,
+		},
+		{
+			name:            "zero is default",
+			data:            "cache:\n  max_entries: 0\nstate:\n  max_observations: 0\n",
+			maxEntries:      10000,
+			maxObservations: 10000,
+		},
+		{
+			name:            "limited",
+			data:            "cache:\n  max_entries: 50\nstate:\n  max_observations: 20\n",
+			maxEntries:      50,
+			maxObservations: 20,
+		},
+		{
+			name:            "unlimited",
+			data:            "cache:\n  max_entries: -1\nstate:\n  max_observations: -1\n",
+			maxEntries:      -1,
+			maxObservations: -1,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			conf := parseTestConfig(t, test.data)
+
+			if conf.Cache.MaxEntries != test.maxEntries {
+				t.Errorf("cache max entries = %d, want %d", conf.Cache.MaxEntries, test.maxEntries)
+			}
+			if conf.State.MaxObservations != test.maxObservations {
+				t.Errorf("state max observations = %d, want %d", conf.State.MaxObservations, test.maxObservations)
+			}
+		})
+	}
+}
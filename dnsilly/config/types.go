@@ -18,16 +18,71 @@ package config
 
 import "time"
 
+// DNS-over-TLS listener configuration
+type ConfigServerTLS struct {
+	// Listener port
+	Port int `default:"853" yaml:"port"`
+
+	// Path to certificate file
+	Cert string `yaml:"cert"`
+
+	// Path to private key file
+	Key string `yaml:"key"`
+}
+
+// DNS-over-HTTPS listener configuration
+type ConfigServerHTTPS struct {
+	// Listener port
+	Port int `default:"443" yaml:"port"`
+
+	// URL path to serve queries on
+	Path string `default:"/dns-query" yaml:"path"`
+
+	// Path to certificate file
+	Cert string `yaml:"cert"`
+
+	// Path to private key file
+	Key string `yaml:"key"`
+}
+
 // Server configuration
 type ConfigServer struct {
 	Host string `yaml:"host"`
 	Port int    `yaml:"port"`
+
+	// Listener protocols, any of: udp, tcp
+	// Defaults to udp only
+	Protocols []string `yaml:"protocols"`
+
+	// DNS-over-TLS listener, optional
+	TLS *ConfigServerTLS `yaml:"tls"`
+
+	// DNS-over-HTTPS listener, optional
+	HTTPS *ConfigServerHTTPS `yaml:"https"`
 }
 
 // DNS Upstream config
 type ConfigUpstream struct {
 	Host string `yaml:"host"`
 	Port int    `yaml:"port"`
+
+	// Encrypted upstream URL, replaces host and port
+	// Supported schemes:
+	// - https://resolver/dns-query - DNS-over-HTTPS
+	// - tls://resolver:853 - DNS-over-TLS
+	URL string `yaml:"url"`
+
+	// TLS server name, defaults to URL host
+	ServerName string `yaml:"server_name"`
+
+	// Base64 SHA-256 pin of server certificate public key (SPKI), optional
+	SPKIPin string `yaml:"spki_pin"`
+
+	// Path to CA certificates file, system roots by default
+	CAFile string `yaml:"ca_file"`
+
+	// Query timeout, 0 for default
+	Timeout time.Duration `yaml:"timeout"`
 }
 
 type ConfigTriggerCommand struct {
@@ -41,7 +96,10 @@ type ConfigTriggerCommand struct {
 	// Accepts parameters:
 	// - {tag} - rule tag
 	// - {domain} - domain name
+	// - {chain} - comma-separated CNAME chain from queried name to final target
 	// - {client_ip} - client ip
+	// - {domain_unicode} - domain in unicode form if `unicode=true`, same as {domain} otherwise
+	// - {meta.<key>} - rule metadata value, empty if missing
 	// - {type} - DNS response type (A or AAAA)
 	// - {ips} - comma-separated list of ips from response if `batch=true`
 	// - {ip} - ip from response if `batch=false`
@@ -50,6 +108,7 @@ type ConfigTriggerCommand struct {
 	// Lifecycle template
 	// Accepts parameters:
 	// - {state} - lifecycle state
+	// - {upstream} - upstream for upstream_down and upstream_up states
 	LifecycleTemplate string `yaml:"lifecycle_template"`
 
 	// Execute on server start
@@ -63,6 +122,16 @@ type ConfigTriggerCommand struct {
 
 	// Execute on server stop during config reload
 	OnPartialStop string `yaml:"on_partial_stop"`
+
+	// Execute when upstream fails health check
+	// Accepts parameters:
+	// - {upstream} - upstream address
+	OnUpstreamDown string `yaml:"on_upstream_down"`
+
+	// Execute when upstream recovers
+	// Accepts parameters:
+	// - {upstream} - upstream address
+	OnUpstreamUp string `yaml:"on_upstream_up"`
 }
 
 type ConfigTriggerJSONHTTP struct {
@@ -74,6 +143,9 @@ type ConfigTriggerJSONHTTP struct {
 	// {
 	//     "tag": "<rule tag>",
 	//     "domain": "<domain name>",
+	//     "chain": [
+	//         "CNAME chain from queried name to final target",
+	//     ],
 	//     "mask": "<dns mask from rule>",
 	//     "ipv4": [
 	//         "comma-separated list of ipv4 in response",
@@ -81,7 +153,11 @@ type ConfigTriggerJSONHTTP struct {
 	//     "ipv6": [
 	//         "comma-separated list of ipv6 in response",
 	//     ],
-	//     "client_ip": "Client IP Address"
+	//     "client_ip": "Client IP Address",
+	//     "meta": {
+	//         "<key>": "<rule metadata value>"
+	//     },
+	//     "domain_unicode": "<domain name in unicode form if unicode=true>"
 	// }
 	EventEndpoint string `yaml:"event_endpoint"`
 
@@ -89,14 +165,111 @@ type ConfigTriggerJSONHTTP struct {
 	// Payload:
 	// {
 	//     "state": "<lifecycle state>",
+	//     "upstream": "<upstream for upstream_down and upstream_up states>"
 	// }
 	LifecycleEndpoint string `yaml:"lifecycle_endpoint"`
 }
 
+// Named group of upstreams
+type ConfigUpstreamGroup struct {
+	// Upstream selection strategy, same as global
+	Strategy string `yaml:"strategy"`
+
+	// Upstreams for DNS resolution
+	Upstreams []*ConfigUpstream `yaml:"upstreams"`
+}
+
+// Conditional forwarding rule
+type ConfigForward struct {
+	// Domain pattern, same syntax as rules
+	Pattern string `yaml:"pattern"`
+
+	// Upstream group name
+	Group string `yaml:"group"`
+}
+
+// Local answers for matching rules
+type ConfigBlock struct {
+	// Rule tag to action:
+	// - nxdomain - reply with NXDOMAIN
+	// - refused - reply with REFUSED
+	// - nodata - reply with empty answer
+	// - null_ip - reply with 0.0.0.0 or ::
+	// - sinkhole - reply with sinkhole address
+	Tags map[string]string `yaml:"tags"`
+
+	// TTL of local answers, 60s by default
+	TTL time.Duration `yaml:"ttl"`
+
+	// Sinkhole addresses for A and AAAA queries
+	SinkholeIPv4 string `yaml:"sinkhole_ipv4"`
+	SinkholeIPv6 string `yaml:"sinkhole_ipv6"`
+}
+
+// Response cache config
+type ConfigCache struct {
+	// Max cached responses, negative for unlimited
+	MaxEntries int `default:"10000" yaml:"max_entries"`
+
+	// Lower TTL limit, 0 to disable
+	MinTTL time.Duration `yaml:"min_ttl"`
+
+	// Upper TTL limit, 0 to disable
+	MaxTTL time.Duration `yaml:"max_ttl"`
+
+	// Fire triggers for responses served from cache
+	TriggerOnHit bool `yaml:"trigger_on_hit"`
+
+	// Serve expired responses when upstreams fail as defined in RFC 8767
+	ServeStale bool `yaml:"serve_stale"`
+
+	// TTL of stale responses, 30s by default
+	StaleTTL time.Duration `yaml:"stale_ttl"`
+
+	// Time expired responses are kept, 24h by default
+	MaxStale time.Duration `yaml:"max_stale"`
+
+	// Refresh popular responses in background shortly before expiry
+	Prefetch bool `yaml:"prefetch"`
+
+	// Hits required for response to be refreshed
+	PrefetchHits int `default:"3" yaml:"prefetch_hits"`
+}
+
+// State snapshot config
+type ConfigState struct {
+	// Snapshot file path
+	Path string `default:"dnsilly.state" yaml:"path"`
+
+	// Fire triggers for loaded observations still matching rules
+	Replay bool `yaml:"replay"`
+
+	// Max remembered observations, least recently seen are dropped, negative for unlimited
+	MaxObservations int `default:"10000" yaml:"max_observations"`
+}
+
+// Upstream health check config
+type ConfigHealthCheck struct {
+	// Probe interval
+	Interval time.Duration `yaml:"interval"`
+
+	// Probe query domain
+	Query string `default:"." yaml:"query"`
+
+	// Probe query type
+	Type string `default:"NS" yaml:"type"`
+
+	// Consecutive failed probes to mark upstream down
+	Failures int `default:"3" yaml:"failures"`
+}
+
 // Trigger config
 type ConfigTrigger struct {
 	Command  []*ConfigTriggerCommand  `yaml:"command"`
 	JSONHTTP []*ConfigTriggerJSONHTTP `yaml:"json_http"`
+
+	// Pass unicode form of punycode domains along with ascii form
+	Unicode bool `yaml:"unicode"`
 }
 
 type Config struct {
@@ -109,10 +282,44 @@ type Config struct {
 	// Server configuration
 	Server *ConfigServer `yaml:"server"`
 
-	// Rules file path
+	// Rules file or directory path
 	Rules string `default:"dnsilly.rules" yaml:"rules"`
 
+	// Directory for downloaded rule lists
+	ListCache string `default:"dnsilly.lists" yaml:"list_cache"`
+
+	// Upstream selection strategy:
+	// - sequential - try upstreams in order until one answers
+	// - parallel - query all upstreams and take first valid answer
+	// - round_robin - rotate first upstream between queries
+	// - fastest - try upstreams in order of measured latency
+	Strategy string `default:"sequential" yaml:"strategy"`
+
 	// Upstreams for DNS resolution
 	Upstreams []*ConfigUpstream `yaml:"upstreams"`
-	Trigger   *ConfigTrigger    `yaml:"trigger"`
+
+	// Named upstream groups for conditional forwarding, optional
+	UpstreamGroups map[string]*ConfigUpstreamGroup `yaml:"upstream_groups"`
+
+	// Conditional forwarding rules, first matching query name selects upstream group
+	// Queries not matching any rule are sent to upstreams
+	Forward []*ConfigForward `yaml:"forward"`
+
+	// TTL of answers from address and cname rules, 60s by default
+	LocalTTL time.Duration `yaml:"local_ttl"`
+
+	// Local answers for matching rules, optional
+	Block *ConfigBlock `yaml:"block"`
+
+	// Response cache, optional
+	Cache *ConfigCache `yaml:"cache"`
+
+	// State snapshot, saved on stop and loaded on start, optional
+	State *ConfigState `yaml:"state"`
+
+	// Upstream health check, optional
+	HealthCheck *ConfigHealthCheck `yaml:"health_check"`
+
+	// Triggers, optional
+	Trigger *ConfigTrigger `yaml:"trigger"`
 }
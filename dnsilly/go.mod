@@ -2,13 +2,16 @@ module dnsilly
 
 go 1.24.5
 
-require github.com/miekg/dns v1.1.68
+require (
+	github.com/miekg/dns v1.1.68
+	golang.org/x/net v0.40.0
+	gopkg.in/yaml.v2 v2.4.0
+)
 
 require (
 	golang.org/x/mod v0.24.0 // indirect
-	golang.org/x/net v0.40.0 // indirect
 	golang.org/x/sync v0.14.0 // indirect
 	golang.org/x/sys v0.33.0 // indirect
+	golang.org/x/text v0.25.0 // indirect
 	golang.org/x/tools v0.33.0 // indirect
-	gopkg.in/yaml.v2 v2.4.0 // indirect
 )
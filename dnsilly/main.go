@@ -25,9 +25,61 @@ import (
 	"fmt"
 	"os"
 	"os/signal"
+	"slices"
 	"time"
 )
 
+// Download due subscriptions, returns true if any list changed
+func refreshSubscriptions(dnsRules *rules.Rules) bool {
+	if dnsRules == nil {
+		return false
+	}
+
+	changed := false
+	for _, sub := range dnsRules.Subscriptions {
+		subChanged, err := sub.Refresh()
+		if err != nil {
+			fmt.Printf("[%s] Error while downloading list %s: %v\n", util.Now(), sub.URL, err)
+			continue
+		}
+
+		if subChanged {
+			fmt.Printf("[%s] Downloaded list: %s\n", util.Now(), sub.URL)
+			changed = true
+		}
+	}
+
+	return changed
+}
+
+// Interval of checking subscriptions for due downloads
+const subscriptionCheckInterval = time.Minute
+
+// Download due subscriptions in background until stopped,
+// signals onChanged if any list changed
+func runSubscriptions(dnsRules *rules.Rules, onChanged chan<- struct{}, onStop <-chan struct{}) {
+	if dnsRules == nil || len(dnsRules.Subscriptions) == 0 {
+		return
+	}
+
+	for {
+		if refreshSubscriptions(dnsRules) {
+			select {
+			case onChanged <- struct{}{}:
+			default:
+			}
+		}
+
+		timer := time.NewTimer(subscriptionCheckInterval)
+		select {
+		case <-onStop:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
+
 func main() {
 	configPath := config.GetConfigPath()
 
@@ -37,6 +89,8 @@ func main() {
 	onExited := make(chan struct{})
 	// Handle error from server
 	onError := make(chan struct{})
+	// Subscribed list downloaded
+	onListsChanged := make(chan struct{}, 1)
 
 	// Status code
 	exitCode := 0
@@ -70,14 +124,14 @@ func main() {
 
 			// Prepare rules
 			fmt.Printf("[%s] Loading rules: %s\n", util.Now(), conf.Rules)
-			dnsRules, err := rules.ParseRules(conf.Rules)
+			dnsRules, rulesFiles, err := rules.ParseRules(conf.Rules, conf.ListCache)
 			if err != nil {
 				fmt.Printf("[%s] Error while reading rules: %s\n", util.Now(), err)
 
 				// This is not fail, just do nothing
 				dnsRules = nil
 			}
-			rulesModTime, err := util.GetFileModificationTime(conf.Rules)
+			rulesModTimes, err := util.GetFilesModificationTimes(rulesFiles)
 			if err != nil {
 				fmt.Printf("[%s] Error while checking rules modification time: %v\n", util.Now(), err)
 
@@ -85,6 +139,10 @@ func main() {
 				dnsRules = nil
 			}
 
+			// Download subscriptions in background
+			onStopSubscriptions := make(chan struct{})
+			go runSubscriptions(dnsRules, onListsChanged, onStopSubscriptions)
+
 			// Start server
 			dnsServer := server.NewServer(conf)
 			dnsServer.SetRules(dnsRules)
@@ -98,6 +156,27 @@ func main() {
 			// Trigger lifecycle
 			triggers.TriggerLifecycle(conf, triggers.OnStart)
 
+			// Parse rules again and pass them to server
+			reloadRules := func() {
+				fmt.Printf("[%s] Reloading rules: %s\n", util.Now(), conf.Rules)
+
+				newRules, newRulesFiles, err := rules.ParseRules(conf.Rules, conf.ListCache)
+				if err != nil {
+					fmt.Printf("[%s] Error while reading rules: %s\n", util.Now(), err)
+				}
+
+				dnsRules = newRules
+				rulesFiles = newRulesFiles
+				rulesModTimes, _ = util.GetFilesModificationTimes(rulesFiles)
+
+				// Subscriptions of new rules replace old ones
+				close(onStopSubscriptions)
+				onStopSubscriptions = make(chan struct{})
+				go runSubscriptions(dnsRules, onListsChanged, onStopSubscriptions)
+
+				dnsServer.SetRules(dnsRules)
+			}
+
 			// Periodically check for config updates
 		checkLoop:
 			for {
@@ -109,6 +188,8 @@ func main() {
 						isRunning = false
 
 						break checkLoop
+					case <-onListsChanged:
+						reloadRules()
 					case <-onError:
 						isRunning = false
 
@@ -172,7 +253,7 @@ func main() {
 						}
 
 						// Check rules modification time
-						newRulesModTime, err := util.GetFileModificationTime(conf.Rules)
+						newRulesModTimes, err := util.GetFilesModificationTimes(rulesFiles)
 						if err != nil {
 							fmt.Printf("[%s] Error while checking rules modification time: %v\n", util.Now(), err)
 
@@ -181,21 +262,8 @@ func main() {
 						}
 
 						// Update rules
-						if (newConfigModTime != configModTime) || (newRulesModTime != rulesModTime) {
-							fmt.Printf("[%s] Reloading rules: %s\n", util.Now(), conf.Rules)
-
-							newRules, err := rules.ParseRules(conf.Rules)
-							if err != nil {
-								fmt.Printf("[%s] Error while reading rules: %s\n", util.Now(), err)
-
-								// This is not fail, just do nothing
-								dnsRules = nil
-							}
-
-							dnsRules = newRules
-							rulesModTime = newRulesModTime
-
-							dnsServer.SetRules(dnsRules)
+						if (newConfigModTime != configModTime) || !slices.Equal(newRulesModTimes, rulesModTimes) {
+							reloadRules()
 						}
 
 						// Continue with server restart
@@ -217,6 +285,8 @@ func main() {
 							triggers.TriggerLifecycle(conf, triggers.OnPartialStart)
 						}
 
+					case <-onListsChanged:
+						reloadRules()
 					case <-onError:
 						isRunning = false
 
@@ -230,6 +300,8 @@ func main() {
 				}
 			}
 
+			close(onStopSubscriptions)
+
 			// Stop server
 			err = dnsServer.Stop()
 			if err != nil {
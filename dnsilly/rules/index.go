@@ -0,0 +1,149 @@
+// dnsilly - dns automation utility
+// Copyright (C) 2025  bitrate16 (bitrate16@gmail.com)
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package rules
+
+import (
+	"strings"
+)
+
+// Characters with special meaning in wildcard patterns
+const wildcardSpecial = "*?^+"
+
+// Reversed-label trie node for suffix rules
+type suffixNode struct {
+	children map[string]*suffixNode
+
+	// Indices of "*.<suffix>" rules ending at this node
+	rules []int
+}
+
+func newSuffixNode() *suffixNode {
+	return &suffixNode{
+		children: make(map[string]*suffixNode),
+	}
+}
+
+func (node *suffixNode) insert(suffix string, index int) {
+	labels := strings.Split(suffix, ".")
+	for i := len(labels) - 1; i >= 0; i-- {
+		child, ok := node.children[labels[i]]
+		if !ok {
+			child = newSuffixNode()
+			node.children[labels[i]] = child
+		}
+		node = child
+	}
+
+	node.rules = append(node.rules, index)
+}
+
+// Index of rules for fast lookup, keeps rule order
+type ruleIndex struct {
+	// Indices of rules matching domain exactly
+	exact map[string][]int
+
+	// Rules matching any subdomain
+	suffix *suffixNode
+
+	// Indices of rules requiring regexp match, ascending
+	scan []int
+}
+
+func isPlain(value string) bool {
+	return !strings.ContainsAny(value, wildcardSpecial)
+}
+
+// Ways to match rule without regexp
+const (
+	// Regexp required
+	matchRegexp = iota
+	// Domain equals value
+	matchExact
+	// "*.<suffix>" - any subdomain of suffix
+	matchSubdomain
+	// "+.<suffix>" - suffix and any subdomain of it
+	matchDomain
+)
+
+// How rule of given kind and value is matched, suffix is returned for subdomain matches
+func plainMatch(kind string, value string) (int, string) {
+	switch {
+	case kind == KindExact:
+		return matchExact, value
+	case kind == KindWildcard && isPlain(value):
+		return matchExact, value
+	case kind == KindWildcard && strings.HasPrefix(value, "*.") && isPlain(value[2:]):
+		return matchSubdomain, value[2:]
+	case kind == KindWildcard && strings.HasPrefix(value, "+.") && isPlain(value[2:]):
+		return matchDomain, value[2:]
+	default:
+		return matchRegexp, ""
+	}
+}
+
+// Domain is subdomain of suffix
+func isSubdomain(domain string, suffix string) bool {
+	return len(domain) > len(suffix)+1 && strings.HasSuffix(domain, suffix) && domain[len(domain)-len(suffix)-1] == '.'
+}
+
+func newRuleIndex(rules []*Rule) *ruleIndex {
+	index := &ruleIndex{
+		exact:  make(map[string][]int),
+		suffix: newSuffixNode(),
+		scan:   make([]int, 0),
+	}
+
+	for i, rule := range rules {
+		mode, value := plainMatch(rule.Kind, rule.value)
+
+		switch mode {
+		case matchExact:
+			index.exact[value] = append(index.exact[value], i)
+		case matchSubdomain:
+			index.suffix.insert(value, i)
+		case matchDomain:
+			index.exact[value] = append(index.exact[value], i)
+			index.suffix.insert(value, i)
+		default:
+			// Rules made without NewRule get here too
+			index.scan = append(index.scan, i)
+		}
+	}
+
+	return index
+}
+
+// Indices of indexed rules matching domain, unordered
+func (index *ruleIndex) lookup(domain string) []int {
+	found := make([]int, 0)
+	found = append(found, index.exact[domain]...)
+
+	labels := strings.Split(domain, ".")
+	node := index.suffix
+	for i := len(labels) - 1; i > 0; i-- {
+		child, ok := node.children[labels[i]]
+		if !ok {
+			break
+		}
+		node = child
+
+		// At least one label left for "*"
+		found = append(found, node.rules...)
+	}
+
+	return found
+}
@@ -0,0 +1,226 @@
+// dnsilly - dns automation utility
+// Copyright (C) 2025  bitrate16 (bitrate16@gmail.com)
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package rules
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"slices"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// Make rule or fail test
+func makeTestRule(t testing.TB, tag string, pattern string) *Rule {
+	t.Helper()
+
+	rule, err := NewRule(tag, pattern)
+	if err != nil {
+		t.Fatalf("%s %s: %v", tag, pattern, err)
+	}
+
+	return rule
+}
+
+// Patterns of rules matched by indexed rule set
+func matchedPatterns(matched []*Rule) []string {
+	patterns := make([]string, 0, len(matched))
+	for _, rule := range matched {
+		patterns = append(patterns, rule.Tag+" "+rule.Pattern)
+	}
+
+	return patterns
+}
+
+// Indexed and linear match of every domain must be equal
+func checkMatchEqual(t *testing.T, list []*Rule, domains []string) {
+	t.Helper()
+
+	indexed := NewRules(list)
+	linear := &Rules{Rules: list}
+
+	clients := []net.IP{nil, net.ParseIP("10.0.0.1"), net.ParseIP("192.168.1.1")}
+	qtypes := []uint16{0, dns.TypeA, dns.TypeAAAA}
+
+	for _, domain := range domains {
+		for _, qtype := range qtypes {
+			for _, client := range clients {
+				want := linear.Match([]byte(domain), qtype, client)
+				got := indexed.Match([]byte(domain), qtype, client)
+
+				if !slices.Equal(got, want) {
+					t.Errorf("%s type %d client %s: indexed %v, linear %v",
+						domain, qtype, client, matchedPatterns(got), matchedPatterns(want))
+				}
+			}
+		}
+	}
+}
+
+func TestMatchIndexEqualsLinear(t *testing.T) {
+	continueRule := makeTestRule(t, "log", "+.example.com")
+	continueRule.Continue = true
+
+	typedRule := makeTestRule(t, "typed", "*.example.com")
+	typedRule.Types = []uint16{dns.TypeAAAA}
+
+	_, network, _ := net.ParseCIDR("10.0.0.0/8")
+	clientRule := makeTestRule(t, "client", "exact:example.com")
+	clientRule.Clients = []*net.IPNet{network}
+	clientRule.Continue = true
+
+	exceptionRule := makeTestRule(t, "block", "exact:good.ads.com")
+	exceptionRule.Exception = true
+
+	stopRule := makeTestRule(t, "", "+.internal.example.com")
+	stopRule.Exception = true
+
+	list := []*Rule{
+		continueRule,
+		clientRule,
+		stopRule,
+		exceptionRule,
+		typedRule,
+		makeTestRule(t, "block", "+.ads.com"),
+		makeTestRule(t, "exact", "exact:example.com"),
+		makeTestRule(t, "regex", "regex:/^(www|api)\\.example\\.com$/"),
+		makeTestRule(t, "wildcard", "ex?mple.*"),
+		makeTestRule(t, "plus", "cdn.+.example.com"),
+		makeTestRule(t, "suffix", "*.example.com"),
+		makeTestRule(t, "plain", "example.com"),
+		makeTestRule(t, "tail", "example.+"),
+		makeTestRule(t, "any", "*"),
+	}
+
+	domains := []string{
+		"example.com",
+		"www.example.com",
+		"api.example.com",
+		"cdn.example.com",
+		"cdn.eu.example.com",
+		"a.b.example.com",
+		"internal.example.com",
+		"host.internal.example.com",
+		"ads.com",
+		"good.ads.com",
+		"bad.ads.com",
+		"exomple.org",
+		"example.org",
+		"com",
+		"other.net",
+	}
+
+	checkMatchEqual(t, list, domains)
+
+	// Same rules in reverse order change precedence
+	reversed := slices.Clone(list)
+	slices.Reverse(reversed)
+	checkMatchEqual(t, reversed, domains)
+
+	// Sanity check of expected matches
+	tests := []struct {
+		domain string
+		qtype  uint16
+		client net.IP
+		want   []string
+	}{
+		{"www.example.com", dns.TypeA, nil, []string{"log +.example.com", "regex regex:/^(www|api)\\.example\\.com$/"}},
+		{"www.example.com", dns.TypeAAAA, nil, []string{"log +.example.com", "typed *.example.com"}},
+		{"example.com", dns.TypeA, net.ParseIP("10.0.0.1"), []string{"log +.example.com", "client exact:example.com", "exact exact:example.com"}},
+		{"example.com", dns.TypeA, net.ParseIP("192.168.1.1"), []string{"log +.example.com", "exact exact:example.com"}},
+		{"host.internal.example.com", dns.TypeA, nil, []string{"log +.example.com"}},
+		{"good.ads.com", dns.TypeA, nil, []string{"any *"}},
+		{"bad.ads.com", dns.TypeA, nil, []string{"block +.ads.com"}},
+		{"other.net", dns.TypeA, nil, []string{"any *"}},
+	}
+
+	indexed := NewRules(list)
+	for _, test := range tests {
+		got := matchedPatterns(indexed.Match([]byte(test.domain), test.qtype, test.client))
+		if !slices.Equal(got, test.want) {
+			t.Errorf("%s: got %v, want %v", test.domain, got, test.want)
+		}
+	}
+}
+
+// Large rule set resembling blocklists with few wildcard and regex rules
+func makeBenchmarkRules(t testing.TB, count int) ([]*Rule, []string) {
+	random := rand.New(rand.NewSource(1))
+
+	list := make([]*Rule, 0, count)
+	domains := make([]string, 0)
+
+	for i := range count {
+		domain := fmt.Sprintf("host%d.domain%d.com", i, random.Intn(count/10+1))
+
+		var pattern string
+		switch i % 100 {
+		case 0:
+			pattern = fmt.Sprintf("regex:/^ads%d[0-9]*\\.net$/", i)
+		case 1, 2:
+			pattern = fmt.Sprintf("tracker%d-*.org", i)
+		case 3, 4, 5, 6, 7, 8, 9, 10, 11, 12:
+			pattern = "*." + domain
+		case 13, 14, 15, 16, 17, 18, 19, 20, 21, 22:
+			pattern = "exact:" + domain
+		default:
+			pattern = "+." + domain
+		}
+
+		rule := makeTestRule(t, "block", pattern)
+		if i%7 == 0 {
+			rule.Continue = true
+		}
+		list = append(list, rule)
+
+		if i%50 == 0 {
+			domains = append(domains, domain, "sub."+domain)
+		}
+	}
+
+	domains = append(domains, "miss.example.com", "ads42.net", "tracker1-x.org")
+
+	return list, domains
+}
+
+func TestMatchIndexEqualsLinearGenerated(t *testing.T) {
+	list, domains := makeBenchmarkRules(t, 2000)
+	checkMatchEqual(t, list, domains)
+}
+
+func BenchmarkMatch(b *testing.B) {
+	list, domains := makeBenchmarkRules(b, 20000)
+
+	benchmarks := []struct {
+		name  string
+		rules *Rules
+	}{
+		{"indexed", NewRules(list)},
+		{"linear", &Rules{Rules: list}},
+	}
+
+	for _, benchmark := range benchmarks {
+		b.Run(benchmark.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				domain := domains[i%len(domains)]
+				benchmark.rules.Match([]byte(domain), dns.TypeA, nil)
+			}
+		})
+	}
+}
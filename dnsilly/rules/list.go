@@ -0,0 +1,198 @@
+// dnsilly - dns automation utility
+// Copyright (C) 2025  bitrate16 (bitrate16@gmail.com)
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package rules
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// "list <tag> <format>:<path>" - load rules with given tag from external list
+const DirectiveList = "list"
+
+// "include <path>" - load rules from file, directory or glob
+const DirectiveInclude = "include"
+
+// External list formats
+const (
+	// "0.0.0.0 ads.com" - hosts file, names match exactly
+	ListHosts = "hosts"
+	// "ads.com" - pattern per line
+	ListDomains = "domains"
+	// "||ads.com^" - Adblock Plus network rules, "@@" prefix for exceptions
+	ListAdblock = "adblock"
+)
+
+// Hosts file names not worth matching
+var hostsIgnored = map[string]bool{
+	"localhost":             true,
+	"localhost.localdomain": true,
+	"local":                 true,
+	"broadcasthost":         true,
+	"ip6-localhost":         true,
+	"ip6-loopback":          true,
+	"ip6-localnet":          true,
+	"ip6-mcastprefix":       true,
+	"ip6-allnodes":          true,
+	"ip6-allrouters":        true,
+	"ip6-allhosts":          true,
+}
+
+// Split list source into format and path
+func parseListSource(source string) (string, string, error) {
+	format, path, ok := strings.Cut(source, ":")
+	if !ok || path == "" {
+		return "", "", fmt.Errorf("invalid list source %s", source)
+	}
+
+	switch format {
+	case ListHosts, ListDomains, ListAdblock:
+		return format, path, nil
+	default:
+		return "", "", fmt.Errorf("unknown list format %s", format)
+	}
+}
+
+// Path relative to directory of rules file
+func resolvePath(configPath string, path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+
+	return filepath.Join(filepath.Dir(configPath), path)
+}
+
+// Load rules from list file
+func loadListFile(tag string, format string, path string) ([]*Rule, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return parseList(tag, format, file)
+}
+
+// Parse external list into rules with given tag, exceptions go first.
+// Entries not supported by format are skipped.
+func parseList(tag string, format string, reader io.Reader) ([]*Rule, error) {
+	exceptions := make([]*Rule, 0)
+	list := make([]*Rule, 0)
+
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		var patterns []string
+		exception := false
+
+		switch format {
+		case ListHosts:
+			patterns = parseHostsLine(scanner.Text())
+		case ListDomains:
+			patterns = parseDomainsLine(scanner.Text())
+		case ListAdblock:
+			patterns, exception = parseAdblockLine(scanner.Text())
+		default:
+			return nil, fmt.Errorf("unknown list format %s", format)
+		}
+
+		for _, pattern := range patterns {
+			rule, err := NewRule(tag, pattern)
+			if err != nil {
+				continue
+			}
+
+			if exception {
+				rule.Exception = true
+				exceptions = append(exceptions, rule)
+			} else {
+				list = append(list, rule)
+			}
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return append(exceptions, list...), nil
+}
+
+// "<ip> <name>..." - every name matches exactly
+func parseHostsLine(line string) []string {
+	line, _, _ = strings.Cut(line, "#")
+
+	fields := strings.Fields(line)
+	if len(fields) < 2 || net.ParseIP(fields[0]) == nil {
+		return nil
+	}
+
+	patterns := make([]string, 0, len(fields)-1)
+	for _, name := range fields[1:] {
+		name = strings.ToLower(name)
+		if hostsIgnored[name] || net.ParseIP(name) != nil {
+			continue
+		}
+
+		patterns = append(patterns, KindExact+":"+name)
+	}
+
+	return patterns
+}
+
+// "<pattern>" - pattern with optional kind prefix
+func parseDomainsLine(line string) []string {
+	line, _, _ = strings.Cut(line, "#")
+
+	fields := strings.Fields(line)
+	if len(fields) != 1 {
+		return nil
+	}
+
+	return fields
+}
+
+// "||<domain>^" - match domain and subdomains, "@@||<domain>^" - exception.
+// Rules with options, paths and cosmetic rules are skipped.
+func parseAdblockLine(line string) ([]string, bool) {
+	line = strings.TrimSpace(line)
+
+	// Comments and headers
+	if line == "" || line[0] == '!' || line[0] == '[' || line[0] == '#' {
+		return nil, false
+	}
+
+	exception := strings.HasPrefix(line, "@@")
+	line = strings.TrimPrefix(line, "@@")
+
+	if !strings.HasPrefix(line, "||") || strings.ContainsAny(line, "$#/:") {
+		return nil, false
+	}
+
+	domain := strings.TrimPrefix(line, "||")
+	domain = strings.TrimSuffix(domain, "|")
+	domain = strings.TrimSuffix(domain, "^")
+	if domain == "" || strings.ContainsAny(domain, "^|+") {
+		return nil, false
+	}
+
+	return []string{"+." + domain}, exception
+}
@@ -0,0 +1,161 @@
+// dnsilly - dns automation utility
+// Copyright (C) 2025  bitrate16 (bitrate16@gmail.com)
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package rules
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestParseHostsLine(t *testing.T) {
+	tests := []struct {
+		line string
+		want []string
+	}{
+		{"0.0.0.0 ads.com", []string{"exact:ads.com"}},
+		{"127.0.0.1\tAds.COM  Tracker.com # comment", []string{"exact:ads.com", "exact:tracker.com"}},
+		{":: ads.com", []string{"exact:ads.com"}},
+		{"127.0.0.1 localhost localhost.localdomain local", []string{}},
+		{"::1 ip6-localhost ip6-loopback", []string{}},
+		{"255.255.255.255 broadcasthost", []string{}},
+		{"0.0.0.0 0.0.0.0", []string{}},
+		{"0.0.0.0 LOCALHOST ads.com", []string{"exact:ads.com"}},
+		{"# 0.0.0.0 ads.com", nil},
+		{"ads.com", nil},
+		{"ads.com 0.0.0.0", nil},
+		{"", nil},
+	}
+
+	for _, test := range tests {
+		if got := parseHostsLine(test.line); !slices.Equal(got, test.want) {
+			t.Errorf("%q: got %v, want %v", test.line, got, test.want)
+		}
+	}
+}
+
+func TestParseAdblockLine(t *testing.T) {
+	tests := []struct {
+		line      string
+		want      []string
+		exception bool
+	}{
+		{line: "||ads.com^", want: []string{"+.ads.com"}},
+		{line: "  ||ads.com^  ", want: []string{"+.ads.com"}},
+		{line: "||ads.com", want: []string{"+.ads.com"}},
+		{line: "||ads.com^|", want: []string{"+.ads.com"}},
+		{line: "@@||good.ads.com^", want: []string{"+.good.ads.com"}, exception: true},
+		{line: "||ads.com^$third-party"},
+		{line: "@@||good.com^$document"},
+		{line: "||ads.com/banner.gif"},
+		{line: "||ads.com:8080^"},
+		{line: "ads.com##.banner"},
+		{line: "example.com#@#.banner"},
+		{line: "/banner/*/img^"},
+		{line: "|https://ads.com^"},
+		{line: "||ads.com^*^"},
+		{line: "||^"},
+		{line: "! Title: list"},
+		{line: "[Adblock Plus 2.0]"},
+		{line: "# comment"},
+		{line: ""},
+	}
+
+	for _, test := range tests {
+		got, exception := parseAdblockLine(test.line)
+		if !slices.Equal(got, test.want) || exception != test.exception {
+			t.Errorf("%q: got %v, %v, want %v, %v", test.line, got, exception, test.want, test.exception)
+		}
+	}
+}
+
+func TestParseList(t *testing.T) {
+	tests := []struct {
+		name   string
+		format string
+		list   string
+		values []string
+
+		// Exceptions go first
+		exceptions int
+	}{
+		{
+			name:   "hosts",
+			format: ListHosts,
+			list: "# hosts\n" +
+				"127.0.0.1 localhost\n" +
+				"::1 ip6-localhost\n" +
+				"0.0.0.0 Ads.COM\n" +
+				"0.0.0.0 tracker.com pixel.tracker.com\n",
+			values: []string{"ads.com", "tracker.com", "pixel.tracker.com"},
+		},
+		{
+			name:   "domains",
+			format: ListDomains,
+			list: "# domains\n" +
+				"Ads.COM\n" +
+				"+.tracker.com # inline comment\n" +
+				"two fields\n" +
+				"regex:/[/\n" +
+				"\n",
+			values: []string{"ads.com", "+.tracker.com"},
+		},
+		{
+			name:   "adblock",
+			format: ListAdblock,
+			list: "[Adblock Plus 2.0]\n" +
+				"! Title: test\n" +
+				"||Ads.COM^\n" +
+				"||tracker.com^$third-party\n" +
+				"||cdn.com/ads/*\n" +
+				"@@||Good.ads.com^\n" +
+				"||pixel.com^\n" +
+				"@@||fine.pixel.com^|\n" +
+				"site.com##.banner\n",
+			values:     []string{"+.good.ads.com", "+.fine.pixel.com", "+.ads.com", "+.pixel.com"},
+			exceptions: 2,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rules, err := parseList("block", test.format, strings.NewReader(test.list))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			values := make([]string, 0, len(rules))
+			for i, rule := range rules {
+				values = append(values, rule.value)
+
+				if rule.Tag != "block" {
+					t.Errorf("%s: tag = %s", rule.Pattern, rule.Tag)
+				}
+				if rule.Exception != (i < test.exceptions) {
+					t.Errorf("%s: exception = %v", rule.Pattern, rule.Exception)
+				}
+			}
+			if !slices.Equal(values, test.values) {
+				t.Errorf("values = %v, want %v", values, test.values)
+			}
+		})
+	}
+
+	if _, err := parseList("block", "unknown", strings.NewReader("ads.com\n")); err == nil {
+		t.Error("unknown format accepted")
+	}
+}
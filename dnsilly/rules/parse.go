@@ -21,9 +21,18 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"io"
+	"net"
 	"os"
+	"path/filepath"
 	"regexp"
+	"slices"
 	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/idna"
 )
 
 // Supported rules:
@@ -32,59 +41,557 @@ import (
 // - "*.foo" - match any ".foo" subdomain
 // - "?" - match single character
 //
-// TODO:
-//
-// Optional dot:
-// - "+.foo" - match "*.foo" and "foo".
-//   - "mar.foo"
-//   - "foo" - only if not starting with
+// Optional labels, "+" must be whole label:
+// - "+.foo" - match "foo" and any subdomain of "foo":
+//   - "foo"
+//   - "bar.foo"
 //
-// - "bar.+.foo" - match anything ending (prefix) or surrounded or with dot or nothing "bar.*.foo" and "bar.foo"
+// - "bar.+.foo" - match "bar.foo" and anything between "bar." and ".foo":
 //   - "bar.foo"
 //   - "bar.tar.foo"
 //
-// - "^" - optional dot (example: "*^bar.com" - match "foo.bar" and "foobar" and "bar")
+// - "foo.+" - match "foo" and anything after "foo."
+//
+// Optional dot:
+// - "^" - match dot or nothing (example: "*^bar.com" - match "foo.bar.com", "foobar.com" and "bar.com")
 //
 // Specific letter classes
 // - "?%" and "*%" - match numeric character
 // - "?$" and "*$" - match letter character
 // - "?@" and "*@" - match non-numeric and non-letter character (example: ".-_")
+//
+// Other characters match literally
 func makeRegexp(matcher string) (*regexp.Regexp, error) {
-	matcher = strings.ReplaceAll(matcher, ".", "\\.")
-	matcher = strings.ReplaceAll(matcher, "*", ".*")
-	matcher = strings.ReplaceAll(matcher, "?", ".")
+	labels := strings.Split(matcher, ".")
+
+	var builder strings.Builder
+	builder.WriteString("^")
+
+	for i, label := range labels {
+		last := i == len(labels)-1
+
+		if label == "+" {
+			switch {
+			case i == 0 && last:
+				builder.WriteString(".*")
+			case last:
+				builder.WriteString("(\\..*)?")
+			default:
+				if i != 0 && labels[i-1] != "+" {
+					builder.WriteString("\\.")
+				}
+
+				// Consumes following dot
+				builder.WriteString("(.*\\.)?")
+			}
+			continue
+		}
+
+		// Dot after optional label is already consumed
+		if i != 0 && labels[i-1] != "+" {
+			builder.WriteString("\\.")
+		}
+
+		builder.WriteString(makeLabelRegexp(label))
+	}
+
+	builder.WriteString("$")
+
+	return regexp.Compile(builder.String())
+}
+
+// Letter classes following "?" or "*"
+var letterClasses = map[rune]string{
+	'%': "[0-9]",
+	'$': "[a-zA-Z]",
+	'@': "[^a-zA-Z0-9]",
+}
+
+// Convert wildcards of single label
+func makeLabelRegexp(label string) string {
+	var builder strings.Builder
+	runes := []rune(label)
+
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+
+		switch r {
+		case '*', '?':
+			class := "."
+			if i+1 < len(runes) {
+				if c, ok := letterClasses[runes[i+1]]; ok {
+					class = c
+					i += 1
+				}
+			}
+
+			builder.WriteString(class)
+			if r == '*' {
+				builder.WriteString("*")
+			}
+		case '^':
+			builder.WriteString("\\.?")
+		default:
+			builder.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+
+	return builder.String()
+}
+
+// Split pattern into kind and value:
+// - "exact:foo.com" - match domain as is
+// - "wildcard:*.foo.com" - wildcard pattern, default when no prefix given
+// - "regex:/^foo[0-9]+\.com$/" - RE2 regular expression
+func parsePattern(pattern string) (string, string, error) {
+	switch {
+	case strings.HasPrefix(pattern, KindExact+":"):
+		return KindExact, strings.TrimPrefix(pattern, KindExact+":"), nil
+	case strings.HasPrefix(pattern, KindWildcard+":"):
+		return KindWildcard, strings.TrimPrefix(pattern, KindWildcard+":"), nil
+	case strings.HasPrefix(pattern, KindRegex+":"):
+		value := strings.TrimPrefix(pattern, KindRegex+":")
+		if len(value) < 2 || value[0] != '/' || value[len(value)-1] != '/' {
+			return "", "", errors.New("regex must be enclosed in slashes")
+		}
+		return KindRegex, value[1 : len(value)-1], nil
+	default:
+		return KindWildcard, pattern, nil
+	}
+}
+
+// Convert unicode labels to punycode and lowercase pattern
+func normalizePattern(value string) (string, error) {
+	labels := strings.Split(value, ".")
+	for i, label := range labels {
+		if isASCII(label) {
+			labels[i] = strings.ToLower(label)
+			continue
+		}
+
+		if strings.ContainsAny(label, wildcardSpecial) {
+			return "", fmt.Errorf("wildcards are not supported in unicode label %s", label)
+		}
+
+		ascii, err := idna.Lookup.ToASCII(label)
+		if err != nil {
+			return "", err
+		}
+		labels[i] = ascii
+	}
+
+	return strings.Join(labels, "."), nil
+}
+
+func isASCII(value string) bool {
+	for i := 0; i < len(value); i++ {
+		if value[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Make rule with given tag and pattern
+func NewRule(tag string, pattern string) (*Rule, error) {
+	kind, value, err := parsePattern(pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	// Domains are matched in lowercase ASCII form
+	if kind != KindRegex {
+		value, err = normalizePattern(value)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if value == "" {
+		return nil, errors.New("empty pattern")
+	}
+
+	// Exact and domain suffix patterns are matched by value, large lists
+	// would spend most of memory on regexps otherwise
+	var regex *regexp.Regexp
+	if mode, _ := plainMatch(kind, value); mode == matchRegexp {
+		switch kind {
+		case KindWildcard:
+			regex, err = makeRegexp(value)
+		case KindRegex:
+			regex, err = regexp.Compile(value)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &Rule{
+		Tag:     tag,
+		Kind:    kind,
+		value:   value,
+		Regexp:  regex,
+		Pattern: pattern,
+	}, nil
+}
+
+// Apply "key=value" qualifier to rule:
+// - "type=A,AAAA" - match queries of listed types only
+// - "client=192.168.1.0/24,10.0.0.1" - match queries from listed networks or addresses only
+// - other keys are metadata passed to triggers
+func parseQualifier(rule *Rule, key string, value string) error {
+	switch key {
+	case "type":
+		for _, name := range strings.Split(value, ",") {
+			qtype, ok := dns.StringToType[strings.ToUpper(name)]
+			if !ok {
+				return fmt.Errorf("unknown query type %s", name)
+			}
+			rule.Types = append(rule.Types, qtype)
+		}
+	case "client":
+		for _, addr := range strings.Split(value, ",") {
+			network, err := parseNetwork(addr)
+			if err != nil {
+				return err
+			}
+			rule.Clients = append(rule.Clients, network)
+		}
+	case "":
+		return errors.New("empty key")
+	default:
+		if rule.Meta == nil {
+			rule.Meta = make(map[string]string)
+		}
+		rule.Meta[key] = value
+	}
+
+	return nil
+}
+
+// "<tag>,<tag>..." - rule fires every tag, at most one tag with local data
+func parseTags(field string) ([]string, string, error) {
+	tags := strings.Split(field, ",")
+
+	local := ""
+	for _, tag := range tags {
+		if tag == "" {
+			return nil, "", errors.New("empty tag")
+		}
+
+		if tag == TagAddress || tag == TagCNAME {
+			if local != "" {
+				return nil, "", errors.New("multiple tags with local data")
+			}
+			local = tag
+		}
+	}
+
+	return tags, local, nil
+}
+
+// Tags of list directive, local data is not supported
+func parseListTags(field string) ([]string, error) {
+	tags, local, err := parseTags(field)
+	if err != nil {
+		return nil, err
+	}
+
+	if local != "" {
+		return nil, fmt.Errorf("tag %s is not supported in lists", local)
+	}
+
+	return tags, nil
+}
+
+// Copy rules for every tag in order, every copy but last continues matching
+func expandTags(list []*Rule, tags []string) []*Rule {
+	if len(tags) == 1 {
+		return list
+	}
+
+	expanded := make([]*Rule, 0, len(list)*len(tags))
+	for _, rule := range list {
+		for i, tag := range tags {
+			copied := *rule
+			copied.Tag = tag
+			copied.Continue = rule.Continue || i != len(tags)-1
+			expanded = append(expanded, &copied)
+		}
+	}
+
+	return expanded
+}
+
+// Parse CIDR network or single address
+func parseNetwork(addr string) (*net.IPNet, error) {
+	if strings.Contains(addr, "/") {
+		_, network, err := net.ParseCIDR(addr)
+		return network, err
+	}
+
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid address %s", addr)
+	}
+
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
+
+// Parse "key=value" fields and flags into qualifiers of empty rule
+func parseQualifiers(fields [][]byte) (*Rule, error) {
+	qualifiers := &Rule{}
+	for _, field := range fields {
+		if string(field) == FlagContinue {
+			qualifiers.Continue = true
+			continue
+		}
+
+		key, value, ok := strings.Cut(string(field), "=")
+		if !ok {
+			return nil, fmt.Errorf("unexpected argument %s", field)
+		}
+
+		err := parseQualifier(qualifiers, key, value)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return qualifiers, nil
+}
+
+// "list <tag> <format>:<path> [key=value]..." - qualifiers apply to every list rule
+func (p *rulesParser) parseListDirective(configPath string, fields [][]byte) ([]*Rule, error) {
+	if len(fields) < 2 {
+		return nil, errors.New("tag and source required")
+	}
+
+	tags, err := parseListTags(string(fields[0]))
+	if err != nil {
+		return nil, err
+	}
+
+	format, path, err := parseListSource(string(fields[1]))
+	if err != nil {
+		return nil, err
+	}
+
+	qualifiers, err := parseQualifiers(fields[2:])
+	if err != nil {
+		return nil, err
+	}
+
+	path = resolvePath(configPath, path)
+	p.files = append(p.files, path)
+
+	rules, err := loadListFile(tags[0], format, path)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, rule := range rules {
+		rule.copyQualifiers(qualifiers)
+	}
+
+	return expandTags(rules, tags), nil
+}
+
+// "subscribe <tag> [<format>:]<url> <interval> [key=value]..." - list is loaded from copy in cache directory
+func parseSubscribeDirective(cacheDir string, fields [][]byte) (*Subscription, error) {
+	if len(fields) < 3 {
+		return nil, errors.New("tag, source and interval required")
+	}
+
+	tags, err := parseListTags(string(fields[0]))
+	if err != nil {
+		return nil, err
+	}
+
+	format, rawURL, err := parseSubscriptionSource(string(fields[1]))
+	if err != nil {
+		return nil, err
+	}
+
+	interval, err := time.ParseDuration(string(fields[2]))
+	if err != nil {
+		return nil, err
+	}
+	if interval <= 0 {
+		return nil, errors.New("interval must be positive")
+	}
+
+	qualifiers, err := parseQualifiers(fields[3:])
+	if err != nil {
+		return nil, err
+	}
 
-	return regexp.Compile("^" + matcher + "$")
+	return newSubscription(cacheDir, tags, format, rawURL, interval, qualifiers), nil
 }
 
-func ParseRules(configPath string) (*Rules, error) {
+// Parse rules file or directory, subscribed lists are loaded from cacheDir.
+// Returns every file and directory read, also on error, to watch for changes.
+func ParseRules(configPath string, cacheDir string) (*Rules, []string, error) {
 	// Create if not exists
 	if _, err := os.Stat(configPath); errors.Is(err, os.ErrNotExist) {
 		f, err := os.Create(configPath)
 		if err != nil {
-			return nil, err
+			return nil, []string{configPath}, err
 		}
 
 		f.WriteString("# Example:\n")
 		f.WriteString("# block example.com\n")
 		f.WriteString("# allow analytics.example.com\n")
 		f.WriteString("# block *.example.com\n")
+		f.WriteString("# !cdn.example.org\n")
+		f.WriteString("# log *.example.org continue\n")
+		f.WriteString("# vpn !static.example.org\n")
+		f.WriteString("# vpn *.example.org\n")
+		f.WriteString("# route-vpn,log *.netflix.com iface=wg0 table=100\n")
+		f.WriteString("# block *.tracker.com type=A,AAAA client=192.168.1.0/24\n")
+		f.WriteString("# address printer.lan 192.168.1.50\n")
+		f.WriteString("# cname www.example.com example.net\n")
+		f.WriteString("# list block hosts:/etc/dnsilly/hosts.txt\n")
+		f.WriteString("# subscribe block adblock:https://example.com/easylist.txt 24h\n")
+		f.WriteString("# include rules.d/*.rules\n")
 		f.Close()
 	}
 
-	// Prepare config
-	file, err := os.Open(configPath)
+	p := &rulesParser{
+		cacheDir:      cacheDir,
+		files:         make([]string, 0),
+		stack:         make([]string, 0),
+		list:          make([]*Rule, 0),
+		subscriptions: make([]*Subscription, 0),
+	}
+
+	err := p.parsePath(configPath)
 	if err != nil {
-		return nil, err
+		return nil, p.files, err
 	}
 
-	scanner := bufio.NewScanner(file)
-	lineno := 0
+	rules := NewRules(p.list)
+	rules.Subscriptions = p.subscriptions
+
+	return rules, p.files, nil
+}
+
+// Rules collected from included files
+type rulesParser struct {
+	cacheDir string
+
+	// Files and directories read
+	files []string
+
+	// Files being parsed to detect include cycle
+	stack []string
+
+	list          []*Rule
+	subscriptions []*Subscription
+}
+
+// Parse file or every file of directory in lexical order, hidden files are skipped
+func (p *rulesParser) parsePath(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		p.files = append(p.files, path)
+		return err
+	}
+
+	if !info.IsDir() {
+		return p.parseFile(path)
+	}
+
+	p.files = append(p.files, path)
+
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+
+		err = p.parseFile(filepath.Join(path, entry.Name()))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// "include <path>" - file, directory or glob relative to including file
+func (p *rulesParser) include(configPath string, pattern string) error {
+	pattern = resolvePath(configPath, pattern)
+	if !strings.ContainsAny(pattern, "*?[\\") {
+		return p.parsePath(pattern)
+	}
+
+	// Watch directory for new matching files
+	if dir := filepath.Dir(pattern); !strings.ContainsAny(dir, "*?[\\") {
+		if _, err := os.Stat(dir); err == nil {
+			p.files = append(p.files, dir)
+		}
+	}
+
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		return err
+	}
+	slices.Sort(matches)
 
-	rules := &Rules{
-		Rules: make([]*Rule, 0),
+	for _, match := range matches {
+		err = p.parsePath(match)
+		if err != nil {
+			return err
+		}
 	}
 
+	return nil
+}
+
+func (p *rulesParser) parseFile(path string) error {
+	p.files = append(p.files, path)
+
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+
+	if slices.Contains(p.stack, absPath) {
+		return fmt.Errorf("include cycle at %s", path)
+	}
+	p.stack = append(p.stack, absPath)
+	defer func() {
+		p.stack = p.stack[:len(p.stack)-1]
+	}()
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	err = p.parseLines(path, file)
+	if err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+
+	return nil
+}
+
+func (p *rulesParser) parseLines(path string, reader io.Reader) error {
+	scanner := bufio.NewScanner(reader)
+	lineno := 0
+
 	for scanner.Scan() {
 		line := scanner.Bytes()
 		lineno += 1
@@ -104,22 +611,126 @@ func ParseRules(configPath string) (*Rules, error) {
 		// Parse rule
 		fields := bytes.Fields(line)
 
-		if len(fields) != 2 {
-			return nil, fmt.Errorf("invalid rule at line %d", lineno)
+		// Exception of all tags has no tag
+		if fields[0][0] == '!' {
+			fields = slices.Insert(fields, 0, []byte{})
+		}
+
+		if len(fields) < 2 {
+			return fmt.Errorf("invalid rule at line %d", lineno)
 		}
 
 		tag := string(fields[0])
-		regex, err := makeRegexp(string(fields[1]))
+
+		// Other rules files
+		if tag == DirectiveInclude {
+			if len(fields) != 2 {
+				return fmt.Errorf("invalid include at line %d", lineno)
+			}
+
+			err := p.include(path, string(fields[1]))
+			if err != nil {
+				return fmt.Errorf("invalid include at line %d: %v", lineno, err)
+			}
+
+			continue
+		}
+
+		// External list
+		if tag == DirectiveList {
+			rules, err := p.parseListDirective(path, fields[1:])
+			if err != nil {
+				return fmt.Errorf("invalid list at line %d: %v", lineno, err)
+			}
+
+			p.list = append(p.list, rules...)
+			continue
+		}
+
+		// Remote list
+		if tag == DirectiveSubscribe {
+			sub, err := parseSubscribeDirective(p.cacheDir, fields[1:])
+			if err != nil {
+				return fmt.Errorf("invalid subscription at line %d: %v", lineno, err)
+			}
+
+			rules, err := sub.load()
+			if err != nil {
+				return fmt.Errorf("invalid subscription at line %d: %v", lineno, err)
+			}
+
+			p.list = append(p.list, rules...)
+			p.subscriptions = append(p.subscriptions, sub)
+			continue
+		}
+
+		// Exception of all tags has empty tag
+		tags, local := []string{tag}, ""
+		if tag != "" {
+			var err error
+			tags, local, err = parseTags(tag)
+			if err != nil {
+				return fmt.Errorf("invalid tag %s at line %d: %v", tag, lineno, err)
+			}
+		}
+
+		// Exception
+		pattern, exception := bytes.CutPrefix(fields[1], []byte("!"))
+
+		rule, err := NewRule(tags[0], string(pattern))
 		if err != nil {
-			return nil, err
+			return fmt.Errorf("invalid pattern %s at line %d: %v", pattern, lineno, err)
+		}
+		rule.Exception = exception
+
+		// Split qualifiers and arguments
+		args := make([]string, 0)
+		for _, field := range fields[2:] {
+			if string(field) == FlagContinue {
+				rule.Continue = true
+				continue
+			}
+
+			key, value, ok := strings.Cut(string(field), "=")
+			if !ok {
+				args = append(args, string(field))
+				continue
+			}
+
+			err = parseQualifier(rule, key, value)
+			if err != nil {
+				return fmt.Errorf("invalid qualifier %s at line %d: %v", field, lineno, err)
+			}
+		}
+
+		switch {
+		case exception && len(args) == 0:
+		case exception:
+			return fmt.Errorf("invalid rule at line %d", lineno)
+		case local == TagAddress && len(args) >= 1:
+		case local == TagCNAME && len(args) == 1:
+		case local == "" && len(args) == 0:
+		default:
+			return fmt.Errorf("invalid rule at line %d", lineno)
+		}
+
+		// Local data
+		switch {
+		case exception:
+		case local == TagAddress:
+			for _, arg := range args {
+				ip := net.ParseIP(arg)
+				if ip == nil {
+					return fmt.Errorf("invalid address %s at line %d", arg, lineno)
+				}
+				rule.Addresses = append(rule.Addresses, ip)
+			}
+		case local == TagCNAME:
+			rule.Target = strings.TrimSuffix(args[0], ".")
 		}
 
-		rules.Rules = append(rules.Rules, &Rule{
-			Tag:     tag,
-			Regexp:  regex,
-			Pattern: string(fields[1]),
-		})
+		p.list = append(p.list, expandTags([]*Rule{rule}, tags)...)
 	}
 
-	return rules, nil
+	return scanner.Err()
 }
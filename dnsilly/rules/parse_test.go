@@ -0,0 +1,623 @@
+// dnsilly - dns automation utility
+// Copyright (C) 2025  bitrate16 (bitrate16@gmail.com)
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package rules
+
+import (
+	"maps"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestMakeRegexp(t *testing.T) {
+	tests := []struct {
+		pattern string
+		match   []string
+		noMatch []string
+	}{
+		{
+			pattern: "*",
+			match:   []string{"foo", "foo.bar.com"},
+		},
+		{
+			pattern: "*.foo",
+			match:   []string{"bar.foo", "a.bar.foo"},
+			noMatch: []string{"foo", "barfoo"},
+		},
+		{
+			pattern: "f?o",
+			match:   []string{"foo", "fxo"},
+			noMatch: []string{"fo", "fooo"},
+		},
+		{
+			pattern: "+",
+			match:   []string{"foo", "foo.bar"},
+		},
+		{
+			pattern: "+.foo",
+			match:   []string{"foo", "bar.foo", "a.bar.foo"},
+			noMatch: []string{"barfoo", "foo.bar", "xfoo"},
+		},
+		{
+			pattern: "bar.+.foo",
+			match:   []string{"bar.foo", "bar.tar.foo", "bar.a.b.foo"},
+			noMatch: []string{"barfoo", "xbar.foo", "bar.foox", "a.bar.foo"},
+		},
+		{
+			pattern: "foo.+",
+			match:   []string{"foo", "foo.bar", "foo.bar.com"},
+			noMatch: []string{"foobar", "bar.foo"},
+		},
+		{
+			pattern: "a.+.+.b",
+			match:   []string{"a.b", "a.x.b", "a.x.y.b"},
+			noMatch: []string{"ab", "a.xb"},
+		},
+		{
+			pattern: "*^bar.com",
+			match:   []string{"foo.bar.com", "foobar.com", "bar.com"},
+			noMatch: []string{"bar.org", "foo.baz.com"},
+		},
+		{
+			pattern: "foo?%.com",
+			match:   []string{"foo1.com", "foo9.com"},
+			noMatch: []string{"fooa.com", "foo.com", "foo12.com"},
+		},
+		{
+			pattern: "foo*%.com",
+			match:   []string{"foo.com", "foo1.com", "foo123.com"},
+			noMatch: []string{"foo1a.com", "fooa.com"},
+		},
+		{
+			pattern: "?$.com",
+			match:   []string{"a.com", "Z.com"},
+			noMatch: []string{"1.com", "-.com", "ab.com"},
+		},
+		{
+			pattern: "*$.com",
+			match:   []string{".com", "abc.com"},
+			noMatch: []string{"a1.com", "a-b.com"},
+		},
+		{
+			pattern: "foo?@bar",
+			match:   []string{"foo-bar", "foo_bar", "foo.bar"},
+			noMatch: []string{"fooxbar", "foo1bar", "foobar"},
+		},
+		{
+			pattern: "foo*@bar",
+			match:   []string{"foobar", "foo-_-bar"},
+			noMatch: []string{"foo-x-bar", "foo1bar"},
+		},
+		{
+			pattern: "foo.com",
+			match:   []string{"foo.com"},
+			noMatch: []string{"fooxcom", "foo.com.org", "xfoo.com"},
+		},
+		{
+			pattern: "a(b)|c[d]\\e{2}",
+			match:   []string{"a(b)|c[d]\\e{2}"},
+			noMatch: []string{"ab", "c", "acd", "a(b)|c[d]\\ee"},
+		},
+		{
+			pattern: "%$@",
+			match:   []string{"%$@"},
+			noMatch: []string{"1a-"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.pattern, func(t *testing.T) {
+			regex, err := makeRegexp(test.pattern)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, domain := range test.match {
+				if !regex.MatchString(domain) {
+					t.Errorf("%s (%s) does not match %s", test.pattern, regex, domain)
+				}
+			}
+			for _, domain := range test.noMatch {
+				if regex.MatchString(domain) {
+					t.Errorf("%s (%s) matches %s", test.pattern, regex, domain)
+				}
+			}
+		})
+	}
+}
+
+func TestNewRule(t *testing.T) {
+	tests := []struct {
+		pattern string
+		kind    string
+		value   string
+		match   []string
+		noMatch []string
+		err     bool
+
+		// Regexp is compiled only for patterns not matched by value
+		compiled bool
+	}{
+		{
+			pattern: "+.Foo.COM",
+			kind:    KindWildcard,
+			value:   "+.foo.com",
+			match:   []string{"foo.com", "bar.foo.com"},
+			noMatch: []string{"barfoo.com", ".foo.com", "foo.com.org"},
+		},
+		{
+			pattern: "wildcard:*.foo.com",
+			kind:    KindWildcard,
+			value:   "*.foo.com",
+			match:   []string{"bar.foo.com", "a.bar.foo.com"},
+			noMatch: []string{"foo.com", "barfoo.com", ".foo.com"},
+		},
+		{
+			pattern: "exact:*.foo.com",
+			kind:    KindExact,
+			value:   "*.foo.com",
+			match:   []string{"*.foo.com"},
+			noMatch: []string{"bar.foo.com"},
+		},
+		{
+			pattern: "exact:foo.com",
+			kind:    KindExact,
+			value:   "foo.com",
+			match:   []string{"foo.com"},
+			noMatch: []string{"fooxcom", "bar.foo.com"},
+		},
+		{
+			pattern: "regex:/^foo[0-9]+\\.com$/",
+			kind:    KindRegex,
+			value:   "^foo[0-9]+\\.com$",
+			match:   []string{"foo1.com", "foo42.com"},
+			noMatch: []string{"foo.com"},
+
+			compiled: true,
+		},
+		{
+			pattern: "foo*.com",
+			kind:    KindWildcard,
+			value:   "foo*.com",
+			match:   []string{"foo.com", "foobar.com"},
+			noMatch: []string{"a.foo.com"},
+
+			compiled: true,
+		},
+		{
+			pattern: "+.foo.+",
+			kind:    KindWildcard,
+			value:   "+.foo.+",
+			match:   []string{"foo", "a.foo.com"},
+			noMatch: []string{"afoo.com"},
+
+			compiled: true,
+		},
+		{
+			pattern: "пример.рф",
+			kind:    KindWildcard,
+			value:   "xn--e1afmkfd.xn--p1ai",
+			match:   []string{"xn--e1afmkfd.xn--p1ai"},
+		},
+		{
+			pattern: "*.пример.рф",
+			kind:    KindWildcard,
+			value:   "*.xn--e1afmkfd.xn--p1ai",
+			match:   []string{"a.xn--e1afmkfd.xn--p1ai"},
+		},
+		{pattern: "regex:^foo$", err: true},
+		{pattern: "regex:/[/", err: true},
+		{pattern: "exact:", err: true},
+		{pattern: "?пример.рф", err: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.pattern, func(t *testing.T) {
+			rule, err := NewRule("tag", test.pattern)
+			if test.err {
+				if err == nil {
+					t.Fatalf("expected error, got rule %s", rule.value)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if rule.Tag != "tag" || rule.Pattern != test.pattern {
+				t.Errorf("tag = %s, pattern = %s", rule.Tag, rule.Pattern)
+			}
+			if rule.Kind != test.kind || rule.value != test.value {
+				t.Errorf("kind = %s, value = %s, want %s, %s", rule.Kind, rule.value, test.kind, test.value)
+			}
+
+			if (rule.Regexp != nil) != test.compiled {
+				t.Errorf("regexp = %v, want compiled %v", rule.Regexp, test.compiled)
+			}
+
+			for _, domain := range test.match {
+				if !rule.matches([]byte(domain)) {
+					t.Errorf("%s does not match %s", test.pattern, domain)
+				}
+			}
+			for _, domain := range test.noMatch {
+				if rule.matches([]byte(domain)) {
+					t.Errorf("%s matches %s", test.pattern, domain)
+				}
+			}
+		})
+	}
+}
+
+// Write files relative to directory, parent directories are created
+func writeTestFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestParseRulesInclude(t *testing.T) {
+	tests := []struct {
+		name     string
+		files    map[string]string
+		path     string
+		patterns []string
+		watched  []string
+		err      string
+	}{
+		{
+			name: "directory in lexical order",
+			files: map[string]string{
+				"rules.d/b.rules":        "block b.com\n",
+				"rules.d/a.rules":        "block a.com\n",
+				"rules.d/10.rules":       "block 10.com\n",
+				"rules.d/.hidden.rules":  "block hidden.com\n",
+				"rules.d/nested/c.rules": "block c.com\n",
+			},
+			path:     "rules.d",
+			patterns: []string{"block 10.com", "block a.com", "block b.com"},
+			watched:  []string{"rules.d", "rules.d/10.rules", "rules.d/a.rules", "rules.d/b.rules"},
+		},
+		{
+			name: "glob include",
+			files: map[string]string{
+				"dnsilly.rules":         "block first.com\ninclude conf.d/*.rules\nblock last.com\n",
+				"conf.d/20-ads.rules":   "block ads.com\n",
+				"conf.d/10-local.rules": "address printer.lan 10.0.0.5\n",
+				"conf.d/readme.txt":     "not rules\n",
+			},
+			path:     "dnsilly.rules",
+			patterns: []string{"block first.com", "address printer.lan", "block ads.com", "block last.com"},
+			watched:  []string{"dnsilly.rules", "conf.d", "conf.d/10-local.rules", "conf.d/20-ads.rules"},
+		},
+		{
+			name: "glob without matches",
+			files: map[string]string{
+				"dnsilly.rules": "include conf.d/*.rules\nblock a.com\n",
+				"conf.d/a.conf": "block b.com\n",
+			},
+			path:     "dnsilly.rules",
+			patterns: []string{"block a.com"},
+			watched:  []string{"dnsilly.rules", "conf.d"},
+		},
+		{
+			name: "include file and directory",
+			files: map[string]string{
+				"dnsilly.rules": "include extra.rules\ninclude rules.d\n",
+				"extra.rules":   "block extra.com\n",
+				"rules.d/a":     "block a.com\n",
+			},
+			path:     "dnsilly.rules",
+			patterns: []string{"block extra.com", "block a.com"},
+			watched:  []string{"dnsilly.rules", "extra.rules", "rules.d", "rules.d/a"},
+		},
+		{
+			name: "include cycle",
+			files: map[string]string{
+				"dnsilly.rules": "include a.rules\n",
+				"a.rules":       "block a.com\ninclude b.rules\n",
+				"b.rules":       "include ./a.rules\n",
+			},
+			path:    "dnsilly.rules",
+			watched: []string{"dnsilly.rules", "a.rules", "b.rules", "a.rules"},
+			err:     "include cycle",
+		},
+		{
+			name: "self include through glob",
+			files: map[string]string{
+				"dnsilly.rules": "include *.rules\n",
+			},
+			path: "dnsilly.rules",
+			err:  "include cycle",
+		},
+		{
+			name: "missing include",
+			files: map[string]string{
+				"dnsilly.rules": "block a.com\ninclude missing.rules\n",
+			},
+			path:    "dnsilly.rules",
+			watched: []string{"dnsilly.rules", "missing.rules"},
+			err:     "invalid include at line 2",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			writeTestFiles(t, dir, test.files)
+
+			rules, files, err := ParseRules(filepath.Join(dir, test.path), t.TempDir())
+
+			// Watched files are returned on error too
+			if test.watched != nil {
+				watched := make([]string, 0, len(files))
+				for _, file := range files {
+					rel, _ := filepath.Rel(dir, file)
+					watched = append(watched, filepath.ToSlash(rel))
+				}
+				if !slices.Equal(watched, test.watched) {
+					t.Errorf("watched = %v, want %v", watched, test.watched)
+				}
+			}
+
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("error = %v, want %s", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if patterns := matchedPatterns(rules.Rules); !slices.Equal(patterns, test.patterns) {
+				t.Errorf("patterns = %v, want %v", patterns, test.patterns)
+			}
+		})
+	}
+}
+
+// Parse rules file with given content
+func parseTestRules(t *testing.T, content string) (*Rules, error) {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "dnsilly.rules")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	rules, _, err := ParseRules(path, t.TempDir())
+	return rules, err
+}
+
+// Query matched against parsed rules
+type testQuery struct {
+	domain  string
+	qtype   uint16
+	client  string
+	matched []string
+}
+
+func checkQueries(t *testing.T, rules *Rules, queries []testQuery) {
+	t.Helper()
+
+	for _, query := range queries {
+		matched := matchedPatterns(rules.Match([]byte(query.domain), query.qtype, net.ParseIP(query.client)))
+		if !slices.Equal(matched, query.matched) {
+			t.Errorf("%s %s from %s: matched %v, want %v", query.domain, dns.TypeToString[query.qtype], query.client, matched, query.matched)
+		}
+	}
+}
+
+func TestParseRulesQualifiers(t *testing.T) {
+	rules, err := parseTestRules(t, ""+
+		"# qualifiers\n"+
+		"block +.ads.test type=A,aaaa\n"+
+		"log +.ads.test client=192.168.1.0/24,10.0.0.1\n"+
+		"vpn +.video.test type=AAAA client=fd00::/64\n"+
+		"route +.video.test\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if rule := rules.Rules[0]; !slices.Equal(rule.Types, []uint16{dns.TypeA, dns.TypeAAAA}) || len(rule.Clients) != 0 {
+		t.Errorf("types = %v, clients = %v", rule.Types, rule.Clients)
+	}
+	if rule := rules.Rules[1]; len(rule.Types) != 0 || len(rule.Clients) != 2 || rule.Clients[1].String() != "10.0.0.1/32" {
+		t.Errorf("types = %v, clients = %v", rule.Types, rule.Clients)
+	}
+
+	checkQueries(t, rules, []testQuery{
+		{domain: "ads.test", qtype: dns.TypeA, client: "10.0.0.2", matched: []string{"block +.ads.test"}},
+		{domain: "x.ads.test", qtype: dns.TypeAAAA, client: "192.168.1.5", matched: []string{"block +.ads.test"}},
+		{domain: "ads.test", qtype: dns.TypeMX, client: "192.168.1.5", matched: []string{"log +.ads.test"}},
+		{domain: "ads.test", qtype: dns.TypeMX, client: "10.0.0.1", matched: []string{"log +.ads.test"}},
+		{domain: "ads.test", qtype: dns.TypeMX, client: "10.0.0.2", matched: []string{}},
+		{domain: "video.test", qtype: dns.TypeAAAA, client: "fd00::5", matched: []string{"vpn +.video.test"}},
+		{domain: "video.test", qtype: dns.TypeAAAA, client: "fd01::5", matched: []string{"route +.video.test"}},
+		{domain: "video.test", qtype: dns.TypeA, client: "fd00::5", matched: []string{"route +.video.test"}},
+	})
+}
+
+func TestParseRulesErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		err     string
+	}{
+		{name: "unknown type", content: "block a.test\nblock b.test type=A,BOGUS\n", err: "invalid qualifier type=A,BOGUS at line 2"},
+		{name: "invalid client", content: "# comment\n\nblock b.test client=300.1.1.1\n", err: "invalid qualifier client=300.1.1.1 at line 3"},
+		{name: "invalid network", content: "block b.test client=10.0.0.0/33\n", err: "invalid qualifier client=10.0.0.0/33 at line 1"},
+		{name: "empty key", content: "block b.test =value\n", err: "invalid qualifier =value at line 1"},
+		{name: "missing pattern", content: "block a.test\nblock\n", err: "invalid rule at line 2"},
+		{name: "unexpected argument", content: "block a.test 10.0.0.1\n", err: "invalid rule at line 1"},
+		{name: "invalid pattern", content: "block a.test\nblock regex:/[/\n", err: "invalid pattern regex:/[/ at line 2"},
+		{name: "invalid address", content: "address a.test 10.0.0.300\n", err: "invalid address 10.0.0.300 at line 1"},
+		{name: "cname without target", content: "cname a.test\n", err: "invalid rule at line 1"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := parseTestRules(t, test.content)
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("error = %v, want %s", err, test.err)
+			}
+		})
+	}
+}
+
+func TestParseRulesExceptions(t *testing.T) {
+	rules, err := parseTestRules(t, ""+
+		"log +.test continue\n"+
+		"block !good.ads.test\n"+
+		"!safe.ads.test\n"+
+		"block +.ads.test\n"+
+		"vpn +.ads.test\n"+
+		"vpn +.video.test continue type=A\n"+
+		"route +.video.test\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if rule := rules.Rules[1]; !rule.Exception || rule.Tag != "block" || rule.Pattern != "good.ads.test" {
+		t.Errorf("tagged exception = %+v", rule)
+	}
+	if rule := rules.Rules[2]; !rule.Exception || rule.Tag != "" || rule.Pattern != "safe.ads.test" {
+		t.Errorf("exception of all tags = %+v", rule)
+	}
+	if !rules.Rules[0].Continue || rules.Rules[3].Continue {
+		t.Errorf("continue = %v, %v", rules.Rules[0].Continue, rules.Rules[3].Continue)
+	}
+
+	checkQueries(t, rules, []testQuery{
+		// Matching stops at first rule without continue
+		{domain: "ads.test", matched: []string{"log +.test", "block +.ads.test"}},
+
+		// Tagged exception hides rules of its tag only
+		{domain: "good.ads.test", matched: []string{"log +.test", "vpn +.ads.test"}},
+
+		// Exception without tag stops matching
+		{domain: "safe.ads.test", matched: []string{"log +.test"}},
+
+		// Continue applies to accepted queries only
+		{domain: "video.test", qtype: dns.TypeA, matched: []string{"log +.test", "vpn +.video.test", "route +.video.test"}},
+		{domain: "video.test", qtype: dns.TypeAAAA, matched: []string{"log +.test", "route +.video.test"}},
+
+		{domain: "other.test", matched: []string{"log +.test"}},
+		{domain: "other.org", matched: []string{}},
+	})
+}
+
+func TestParseRulesExceptionErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		err     string
+	}{
+		{name: "exception with address", content: "address a.test 10.0.0.1\naddress !b.test 10.0.0.2\n", err: "invalid rule at line 2"},
+		{name: "exception with argument", content: "block !a.test extra\n", err: "invalid rule at line 1"},
+		{name: "empty exception", content: "block a.test\nblock !\n", err: "invalid pattern  at line 2"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := parseTestRules(t, test.content)
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("error = %v, want %s", err, test.err)
+			}
+		})
+	}
+}
+
+func TestParseRulesTagsAndMeta(t *testing.T) {
+	rules, err := parseTestRules(t, ""+
+		"route-vpn,log +.netflix.test iface=wg0 table=100 type=A\n"+
+		"block,log ads.test continue note=\n"+
+		"vpn +.test\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Every tag gets copy of rule, every copy but last continues matching
+	tests := []struct {
+		tag       string
+		continued bool
+		meta      map[string]string
+	}{
+		{tag: "route-vpn", continued: true, meta: map[string]string{"iface": "wg0", "table": "100"}},
+		{tag: "log", continued: false, meta: map[string]string{"iface": "wg0", "table": "100"}},
+		{tag: "block", continued: true, meta: map[string]string{"note": ""}},
+		{tag: "log", continued: true, meta: map[string]string{"note": ""}},
+		{tag: "vpn", continued: false},
+	}
+
+	if len(rules.Rules) != len(tests) {
+		t.Fatalf("rules = %v", matchedPatterns(rules.Rules))
+	}
+	for i, test := range tests {
+		rule := rules.Rules[i]
+		if rule.Tag != test.tag || rule.Continue != test.continued || !maps.Equal(rule.Meta, test.meta) {
+			t.Errorf("rule %d: tag = %s, continue = %v, meta = %v", i, rule.Tag, rule.Continue, rule.Meta)
+		}
+	}
+	if !slices.Equal(rules.Rules[0].Types, []uint16{dns.TypeA}) || !slices.Equal(rules.Rules[1].Types, []uint16{dns.TypeA}) {
+		t.Errorf("types = %v, %v", rules.Rules[0].Types, rules.Rules[1].Types)
+	}
+
+	checkQueries(t, rules, []testQuery{
+		{domain: "www.netflix.test", qtype: dns.TypeA, matched: []string{"route-vpn +.netflix.test", "log +.netflix.test"}},
+		{domain: "www.netflix.test", qtype: dns.TypeAAAA, matched: []string{"vpn +.test"}},
+
+		// Last copy of continued rule keeps continuing
+		{domain: "ads.test", matched: []string{"block ads.test", "log ads.test", "vpn +.test"}},
+	})
+}
+
+func TestParseRulesTagErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		err     string
+	}{
+		{name: "empty tag", content: "block a.test\nblock,,log b.test\n", err: "invalid tag block,,log at line 2"},
+		{name: "trailing comma", content: "block, b.test\n", err: "invalid tag block, at line 1"},
+		{name: "multiple local tags", content: "address,cname b.test c.test\n", err: "invalid tag address,cname at line 1"},
+		{name: "local tag in list", content: "list address,log hosts:hosts.txt\n", err: "invalid list at line 1"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := parseTestRules(t, test.content)
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("error = %v, want %s", err, test.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,278 @@
+// dnsilly - dns automation utility
+// Copyright (C) 2025  bitrate16 (bitrate16@gmail.com)
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package rules
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// "subscribe <tag> [<format>:]<url> <interval>" - load rules with given tag from remote list
+const DirectiveSubscribe = "subscribe"
+
+// Timeout of list download
+const subscriptionTimeout = 30 * time.Second
+
+// Delay before retrying failed download, interval is used if shorter
+const subscriptionRetry = 5 * time.Minute
+
+// Max size of downloaded list
+var maxSubscriptionSize int64 = 64 << 20
+
+var subscriptionClient = &http.Client{
+	Timeout: subscriptionTimeout,
+}
+
+// Remote list downloaded periodically, last good copy is kept on disk
+type Subscription struct {
+	Tags     []string
+	Format   string
+	URL      string
+	Interval time.Duration
+
+	// Qualifiers applied to every rule of list
+	qualifiers *Rule
+
+	// Downloaded list and its metadata
+	path     string
+	metaPath string
+}
+
+// Download metadata for conditional requests
+type subscriptionMeta struct {
+	URL          string    `json:"url"`
+	ETag         string    `json:"etag,omitempty"`
+	LastModified string    `json:"last_modified,omitempty"`
+	Checksum     string    `json:"checksum"`
+	Fetched      time.Time `json:"fetched"`
+
+	// Next download attempt after failure
+	Retry time.Time `json:"retry,omitempty"`
+}
+
+// Split subscription source into format and url, domains format by default
+func parseSubscriptionSource(source string) (string, string, error) {
+	format, rawURL := ListDomains, source
+	if prefix, rest, ok := strings.Cut(source, ":"); ok {
+		switch prefix {
+		case ListHosts, ListDomains, ListAdblock:
+			format, rawURL = prefix, rest
+		}
+	}
+
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return "", "", err
+	}
+
+	if parsed.Scheme != "http" && parsed.Scheme != "https" {
+		return "", "", fmt.Errorf("unsupported list url %s", rawURL)
+	}
+
+	return format, rawURL, nil
+}
+
+func newSubscription(cacheDir string, tags []string, format string, rawURL string, interval time.Duration, qualifiers *Rule) *Subscription {
+	sum := sha256.Sum256([]byte(rawURL))
+	name := hex.EncodeToString(sum[:8])
+
+	return &Subscription{
+		Tags:     tags,
+		Format:   format,
+		URL:      rawURL,
+		Interval: interval,
+
+		qualifiers: qualifiers,
+
+		path:     filepath.Join(cacheDir, name+".list"),
+		metaPath: filepath.Join(cacheDir, name+".json"),
+	}
+}
+
+// Rules from last downloaded copy, empty if list was never downloaded
+func (sub *Subscription) load() ([]*Rule, error) {
+	rules, err := loadListFile(sub.Tags[0], sub.Format, sub.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, rule := range rules {
+		rule.copyQualifiers(sub.qualifiers)
+	}
+
+	return expandTags(rules, sub.Tags), nil
+}
+
+func (sub *Subscription) readMeta() *subscriptionMeta {
+	meta := &subscriptionMeta{}
+
+	data, err := os.ReadFile(sub.metaPath)
+	if err != nil {
+		return meta
+	}
+
+	// Metadata of other url after hash collision is ignored
+	if json.Unmarshal(data, meta) != nil || meta.URL != sub.URL {
+		return &subscriptionMeta{}
+	}
+
+	return meta
+}
+
+func (sub *Subscription) writeMeta(meta *subscriptionMeta) error {
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(sub.metaPath), 0755)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(sub.metaPath, data, 0644)
+}
+
+// Download list if interval passed, returns true if list content changed.
+// Failed download keeps last good copy and is retried after delay kept in metadata.
+func (sub *Subscription) Refresh() (bool, error) {
+	now := time.Now()
+
+	meta := sub.readMeta()
+	if now.Before(meta.Retry) || now.Sub(meta.Fetched) < sub.Interval {
+		return false, nil
+	}
+
+	changed, err := sub.download(meta)
+	if err != nil {
+		meta.URL = sub.URL
+		meta.Retry = now.Add(min(sub.Interval, subscriptionRetry))
+
+		return false, errors.Join(err, sub.writeMeta(meta))
+	}
+
+	return changed, nil
+}
+
+func (sub *Subscription) download(meta *subscriptionMeta) (bool, error) {
+	request, err := http.NewRequest(http.MethodGet, sub.URL, nil)
+	if err != nil {
+		return false, err
+	}
+
+	// Conditional request only if copy exists
+	if _, err := os.Stat(sub.path); err == nil {
+		if meta.ETag != "" {
+			request.Header.Set("If-None-Match", meta.ETag)
+		}
+		if meta.LastModified != "" {
+			request.Header.Set("If-Modified-Since", meta.LastModified)
+		}
+	}
+
+	response, err := subscriptionClient.Do(request)
+	if err != nil {
+		return false, err
+	}
+	defer response.Body.Close()
+
+	switch response.StatusCode {
+	case http.StatusNotModified:
+		meta.Fetched = time.Now()
+		meta.Retry = time.Time{}
+		return false, sub.writeMeta(meta)
+	case http.StatusOK:
+	default:
+		return false, fmt.Errorf("unexpected status %s", response.Status)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(response.Body, maxSubscriptionSize+1))
+	if err != nil {
+		return false, err
+	}
+	if int64(len(data)) > maxSubscriptionSize {
+		return false, fmt.Errorf("list exceeds %d bytes", maxSubscriptionSize)
+	}
+
+	// Empty list or error page must not replace last good copy
+	if strings.HasPrefix(http.DetectContentType(data), "text/html") {
+		return false, errors.New("list is html page")
+	}
+
+	rules, err := parseList(sub.Tags[0], sub.Format, bytes.NewReader(data))
+	if err != nil {
+		return false, err
+	}
+	if len(rules) == 0 {
+		return false, errors.New("list has no rules")
+	}
+
+	err = os.MkdirAll(filepath.Dir(sub.path), 0755)
+	if err != nil {
+		return false, err
+	}
+
+	// Replace copy atomically, temporary file is unique in case other refresh is running
+	tmpFile, err := os.CreateTemp(filepath.Dir(sub.path), filepath.Base(sub.path)+".*.tmp")
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(tmpFile.Name())
+
+	err = tmpFile.Chmod(0644)
+	if err == nil {
+		_, err = tmpFile.Write(data)
+	}
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return false, err
+	}
+
+	err = os.Rename(tmpFile.Name(), sub.path)
+	if err != nil {
+		return false, err
+	}
+
+	sum := sha256.Sum256(data)
+	checksum := hex.EncodeToString(sum[:])
+	changed := checksum != meta.Checksum
+
+	meta.URL = sub.URL
+	meta.ETag = response.Header.Get("ETag")
+	meta.LastModified = response.Header.Get("Last-Modified")
+	meta.Checksum = checksum
+	meta.Fetched = time.Now()
+	meta.Retry = time.Time{}
+
+	return changed, sub.writeMeta(meta)
+}
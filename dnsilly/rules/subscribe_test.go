@@ -0,0 +1,220 @@
+// dnsilly - dns automation utility
+// Copyright (C) 2025  bitrate16 (bitrate16@gmail.com)
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package rules
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// List server answering conditional requests by ETag
+type testListServer struct {
+	lock sync.Mutex
+
+	body   string
+	etag   string
+	status int
+
+	// Requests served and requests answered with 304
+	requests    int
+	notModified int
+}
+
+func (s *testListServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.requests += 1
+
+	if s.status != 0 {
+		http.Error(w, "failure", s.status)
+		return
+	}
+
+	if r.Header.Get("If-None-Match") == s.etag {
+		s.notModified += 1
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.Header().Set("ETag", s.etag)
+	w.Write([]byte(s.body))
+}
+
+func (s *testListServer) set(body string, etag string, status int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.body, s.etag, s.status = body, etag, status
+}
+
+// Patterns of rules loaded from last downloaded copy
+func loadedPatterns(t *testing.T, sub *Subscription) []string {
+	t.Helper()
+
+	rules, err := sub.load()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	patterns := make([]string, 0, len(rules))
+	for _, rule := range rules {
+		patterns = append(patterns, rule.Pattern)
+	}
+
+	return patterns
+}
+
+func checkRefresh(t *testing.T, sub *Subscription, wantChanged bool, wantErr bool) {
+	t.Helper()
+
+	changed, err := sub.Refresh()
+	if (err != nil) != wantErr {
+		t.Fatalf("error = %v, want error %v", err, wantErr)
+	}
+	if changed != wantChanged {
+		t.Fatalf("changed = %v, want %v", changed, wantChanged)
+	}
+}
+
+func TestSubscriptionRefresh(t *testing.T) {
+	listServer := &testListServer{body: "ads.com\ntracker.com\n", etag: `"v1"`}
+	server := httptest.NewServer(listServer)
+	defer server.Close()
+
+	sub := newSubscription(t.TempDir(), []string{"block"}, ListDomains, server.URL+"/list.txt", 0, &Rule{})
+
+	// Never downloaded
+	if patterns := loadedPatterns(t, sub); len(patterns) != 0 {
+		t.Fatalf("rules before download: %v", patterns)
+	}
+
+	checkRefresh(t, sub, true, false)
+	if patterns := loadedPatterns(t, sub); !slices.Equal(patterns, []string{"ads.com", "tracker.com"}) {
+		t.Fatalf("rules after download: %v", patterns)
+	}
+
+	// Revalidated with ETag
+	checkRefresh(t, sub, false, false)
+	if listServer.notModified != 1 {
+		t.Fatalf("not modified responses = %d, want 1", listServer.notModified)
+	}
+
+	// Changed list
+	listServer.set("ads.com\n", `"v2"`, 0)
+	checkRefresh(t, sub, true, false)
+	if patterns := loadedPatterns(t, sub); !slices.Equal(patterns, []string{"ads.com"}) {
+		t.Fatalf("rules after change: %v", patterns)
+	}
+
+	// Same content under new ETag is not a change
+	listServer.set("ads.com\n", `"v3"`, 0)
+	checkRefresh(t, sub, false, false)
+
+	// Failed download keeps last good copy
+	listServer.set("", "", http.StatusInternalServerError)
+	checkRefresh(t, sub, false, true)
+	if patterns := loadedPatterns(t, sub); !slices.Equal(patterns, []string{"ads.com"}) {
+		t.Fatalf("rules after failure: %v", patterns)
+	}
+
+	// Unreachable server keeps last good copy too
+	server.Close()
+	checkRefresh(t, sub, false, true)
+	if patterns := loadedPatterns(t, sub); !slices.Equal(patterns, []string{"ads.com"}) {
+		t.Fatalf("rules after unreachable server: %v", patterns)
+	}
+}
+
+func TestSubscriptionInterval(t *testing.T) {
+	listServer := &testListServer{body: "ads.com\n", etag: `"v1"`}
+	server := httptest.NewServer(listServer)
+	defer server.Close()
+
+	cacheDir := t.TempDir()
+	sub := newSubscription(cacheDir, []string{"block"}, ListDomains, server.URL, time.Hour, &Rule{})
+
+	checkRefresh(t, sub, true, false)
+
+	// Not due until interval passes
+	checkRefresh(t, sub, false, false)
+	if listServer.requests != 1 {
+		t.Fatalf("requests = %d, want 1", listServer.requests)
+	}
+
+	// Failed download is retried after delay
+	meta := sub.readMeta()
+	meta.Fetched = time.Now().Add(-2 * time.Hour)
+	if err := sub.writeMeta(meta); err != nil {
+		t.Fatal(err)
+	}
+
+	listServer.set("", "", http.StatusServiceUnavailable)
+	checkRefresh(t, sub, false, true)
+	checkRefresh(t, sub, false, false)
+	if listServer.requests != 2 {
+		t.Fatalf("requests = %d, want 2", listServer.requests)
+	}
+
+	// Delay survives subscription rebuilt on rules reload
+	sub = newSubscription(cacheDir, []string{"block"}, ListDomains, server.URL, time.Hour, &Rule{})
+	checkRefresh(t, sub, false, false)
+	if listServer.requests != 2 {
+		t.Fatalf("requests after reload = %d, want 2", listServer.requests)
+	}
+	if patterns := loadedPatterns(t, sub); !slices.Equal(patterns, []string{"ads.com"}) {
+		t.Fatalf("rules after failure: %v", patterns)
+	}
+}
+
+func TestSubscriptionRejectedBody(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+	}{
+		{name: "empty", body: ""},
+		{name: "comments only", body: "# list is empty\n"},
+		{name: "error page", body: "<html>\n<body>Service Unavailable</body>\n</html>\n"},
+		{name: "too large", body: strings.Repeat("a.com\n", 100)},
+	}
+
+	defer func(size int64) { maxSubscriptionSize = size }(maxSubscriptionSize)
+	maxSubscriptionSize = 64
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			listServer := &testListServer{body: "ads.com\n", etag: `"v1"`}
+			server := httptest.NewServer(listServer)
+			defer server.Close()
+
+			sub := newSubscription(t.TempDir(), []string{"block"}, ListDomains, server.URL, 0, &Rule{})
+			checkRefresh(t, sub, true, false)
+
+			// Last good copy is kept
+			listServer.set(test.body, `"v2"`, 0)
+			checkRefresh(t, sub, false, true)
+			if patterns := loadedPatterns(t, sub); !slices.Equal(patterns, []string{"ads.com"}) {
+				t.Fatalf("rules after rejected body: %v", patterns)
+			}
+		})
+	}
+}
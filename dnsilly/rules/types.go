@@ -17,29 +17,201 @@
 package rules
 
 import (
+	"net"
 	"regexp"
+	"slices"
+)
+
+// Rule tags answering from local data
+const (
+	// "address <pattern> <ip>..." - answer A and AAAA queries with given addresses
+	TagAddress = "address"
+	// "cname <pattern> <target>" - answer with CNAME to target resolved upstream
+	TagCNAME = "cname"
+)
+
+// "<tag> <pattern> continue" - continue matching following rules after match
+const FlagContinue = "continue"
+
+// Pattern kinds
+const (
+	KindExact    = "exact"
+	KindWildcard = "wildcard"
+	KindRegex    = "regex"
 )
 
 type Rule struct {
+	// Compiled pattern, nil for exact and domain suffix patterns matched by value
 	Regexp  *regexp.Regexp
 	Pattern string
 	Tag     string
+
+	// Pattern kind, one of exact, wildcard and regex
+	Kind string
+	// Normalized pattern without kind prefix
+	value string
+
+	// Addresses of address rule
+	Addresses []net.IP
+	// Target of cname rule
+	Target string
+
+	// Query types rule applies to, any if empty
+	Types []uint16
+	// Client networks rule applies to, any if empty
+	Clients []*net.IPNet
+
+	// Matching domain is excluded from following rules with same tag,
+	// from all following rules if tag is empty
+	Exception bool
+
+	// Continue matching following rules after match
+	Continue bool
+
+	// "key=value" metadata passed to triggers
+	Meta map[string]string
+}
+
+// Copy qualifiers of list directive to list rule
+func (rule *Rule) copyQualifiers(qualifiers *Rule) {
+	rule.Types = qualifiers.Types
+	rule.Clients = qualifiers.Clients
+	rule.Continue = qualifiers.Continue
+	rule.Meta = qualifiers.Meta
+}
+
+// Rule pattern matches domain
+func (rule *Rule) matches(domain []byte) bool {
+	if rule.Regexp != nil {
+		return rule.Regexp.Match(domain)
+	}
+
+	mode, value := plainMatch(rule.Kind, rule.value)
+	switch mode {
+	case matchExact:
+		return string(domain) == value
+	case matchSubdomain:
+		return isSubdomain(string(domain), value)
+	case matchDomain:
+		return string(domain) == value || isSubdomain(string(domain), value)
+	default:
+		return false
+	}
+}
+
+// Rule is answered from local data
+func (rule *Rule) IsLocal() bool {
+	return rule.Tag == TagAddress || rule.Tag == TagCNAME
+}
+
+// Rule applies to query of given type from given client,
+// zero type or nil client are unknown and not filtered
+func (rule *Rule) Accepts(qtype uint16, client net.IP) bool {
+	if qtype != 0 && len(rule.Types) != 0 && !slices.Contains(rule.Types, qtype) {
+		return false
+	}
+
+	if client != nil && len(rule.Clients) != 0 {
+		return slices.ContainsFunc(rule.Clients, func(network *net.IPNet) bool {
+			return network.Contains(client)
+		})
+	}
+
+	return true
 }
 
 type Rules struct {
 	Rules []*Rule
+
+	// Remote lists rules were loaded from
+	Subscriptions []*Subscription
+
+	// Built by NewRules, linear scan if missing
+	index *ruleIndex
+}
+
+// Make rule set with index for fast matching
+func NewRules(rules []*Rule) *Rules {
+	return &Rules{
+		Rules: rules,
+		index: newRuleIndex(rules),
+	}
 }
 
-func (rules *Rules) Match(domain []byte) *Rule {
+// Rules matching domain and accepting query type and client in order,
+// matching stops after first rule without continue flag.
+// Every tag matches once, exception hides following rules with same tag,
+// exception without tag stops matching.
+func (rules *Rules) Match(domain []byte, qtype uint16, client net.IP) []*Rule {
 	if rules == nil {
 		return nil
 	}
 
-	for _, rule := range rules.Rules {
-		if rule.Regexp.Match(domain) {
-			return rule
+	var matched []*Rule
+
+	// Tags already matched or hidden by exceptions
+	var excluded map[string]bool
+
+	// Apply matching rule, returns false to stop matching
+	apply := func(rule *Rule) bool {
+		if excluded[rule.Tag] {
+			return true
+		}
+
+		if rule.Exception && rule.Tag == "" {
+			return false
+		}
+
+		if excluded == nil {
+			excluded = make(map[string]bool)
+		}
+		excluded[rule.Tag] = true
+
+		if rule.Exception {
+			return true
+		}
+
+		matched = append(matched, rule)
+
+		return rule.Continue
+	}
+
+	if rules.index == nil {
+		for _, rule := range rules.Rules {
+			if rule.Accepts(qtype, client) && rule.matches(domain) && !apply(rule) {
+				break
+			}
+		}
+
+		return matched
+	}
+
+	// Indexed matches in rule order
+	candidates := make([]int, 0)
+	for _, i := range rules.index.lookup(string(domain)) {
+		if rules.Rules[i].Accepts(qtype, client) {
+			candidates = append(candidates, i)
+		}
+	}
+	slices.Sort(candidates)
+
+	// Merge with rules requiring regexp match
+	scan := rules.index.scan
+	for len(candidates) != 0 || len(scan) != 0 {
+		var rule *Rule
+		if len(scan) != 0 && (len(candidates) == 0 || scan[0] < candidates[0]) {
+			rule, scan = rules.Rules[scan[0]], scan[1:]
+			if !rule.Accepts(qtype, client) || !rule.matches(domain) {
+				continue
+			}
+		} else {
+			rule, candidates = rules.Rules[candidates[0]], candidates[1:]
+		}
+
+		if !apply(rule) {
+			break
 		}
 	}
 
-	return nil
+	return matched
 }
@@ -0,0 +1,177 @@
+// dnsilly - dns automation utility
+// Copyright (C) 2025  bitrate16 (bitrate16@gmail.com)
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"dnsilly/config"
+	"dnsilly/rules"
+	"dnsilly/util"
+	"fmt"
+	"net"
+	"slices"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Local answer actions for rule tags
+const (
+	// Reply with NXDOMAIN
+	ActionNXDomain = "nxdomain"
+	// Reply with REFUSED
+	ActionRefused = "refused"
+	// Reply with empty answer
+	ActionNoData = "nodata"
+	// Reply with 0.0.0.0 or ::
+	ActionNull = "null_ip"
+	// Reply with configured sinkhole address
+	ActionSinkhole = "sinkhole"
+)
+
+// Default TTL of local answers
+const defaultBlockTTL = 60 * time.Second
+
+// Check configured actions and sinkhole addresses
+func validateBlock(conf *config.ConfigBlock) error {
+	for tag, action := range conf.Tags {
+		switch action {
+		case ActionNXDomain, ActionRefused, ActionNoData, ActionNull:
+		case ActionSinkhole:
+			if conf.SinkholeIPv4 == "" && conf.SinkholeIPv6 == "" {
+				return fmt.Errorf("block tag %s: no sinkhole address", tag)
+			}
+		default:
+			return fmt.Errorf("block tag %s: unsupported action: %s", tag, action)
+		}
+	}
+
+	if conf.SinkholeIPv4 != "" && net.ParseIP(conf.SinkholeIPv4).To4() == nil {
+		return fmt.Errorf("invalid sinkhole ipv4: %s", conf.SinkholeIPv4)
+	}
+
+	if conf.SinkholeIPv6 != "" && net.ParseIP(conf.SinkholeIPv6) == nil {
+		return fmt.Errorf("invalid sinkhole ipv6: %s", conf.SinkholeIPv6)
+	}
+
+	return nil
+}
+
+// Answer address for A or AAAA query, nil for other types
+func blockAddress(conf *config.ConfigBlock, action string, qtype uint16) net.IP {
+	switch {
+	case action == ActionNull && qtype == dns.TypeA:
+		return net.IPv4zero
+	case action == ActionNull && qtype == dns.TypeAAAA:
+		return net.IPv6zero
+	case action == ActionSinkhole && qtype == dns.TypeA && conf.SinkholeIPv4 != "":
+		return net.ParseIP(conf.SinkholeIPv4)
+	case action == ActionSinkhole && qtype == dns.TypeAAAA && conf.SinkholeIPv6 != "":
+		return net.ParseIP(conf.SinkholeIPv6)
+	}
+
+	return nil
+}
+
+// Answer queries matching rules with block action locally
+func (s *Server) blockHandler(w dns.ResponseWriter, request *dns.Msg) bool {
+	if len(request.Question) != 1 {
+		return true
+	}
+
+	question := request.Question[0]
+	domain := normalizeDomain(question.Name)
+
+	client_ip := clientIP(w)
+
+	matched := s.rules.Load().Match([]byte(domain), question.Qtype, net.ParseIP(client_ip))
+
+	// First matched rule with block action
+	conf := s.config.Block
+	i := slices.IndexFunc(matched, func(rule *rules.Rule) bool {
+		_, ok := conf.Tags[rule.Tag]
+		return ok
+	})
+	if i == -1 {
+		return true
+	}
+	action := conf.Tags[matched[i].Tag]
+
+	if s.config.Verbose {
+		fmt.Printf("[%s] Block %s: %s\n", util.Now(), domain, action)
+	}
+
+	ttl := uint32(defaultBlockTTL.Seconds())
+	if conf.TTL != 0 {
+		ttl = uint32(conf.TTL.Seconds())
+	}
+
+	response := &dns.Msg{}
+	response.SetReply(request)
+	response.RecursionAvailable = true
+
+	ipv4 := make([]string, 0)
+	ipv6 := make([]string, 0)
+
+	switch action {
+	case ActionNXDomain:
+		response.Rcode = dns.RcodeNameError
+	case ActionRefused:
+		response.Rcode = dns.RcodeRefused
+	}
+
+	if ip := blockAddress(conf, action, question.Qtype); ip != nil {
+		header := dns.RR_Header{
+			Name:   question.Name,
+			Rrtype: question.Qtype,
+			Class:  question.Qclass,
+			Ttl:    ttl,
+		}
+
+		if question.Qtype == dns.TypeA {
+			response.Answer = append(response.Answer, &dns.A{Hdr: header, A: ip})
+			ipv4 = append(ipv4, ip.String())
+		} else {
+			response.Answer = append(response.Answer, &dns.AAAA{Hdr: header, AAAA: ip})
+			ipv6 = append(ipv6, ip.String())
+		}
+	}
+
+	// SOA for negative caching as defined in RFC 2308
+	if len(response.Answer) == 0 && response.Rcode != dns.RcodeRefused {
+		response.Ns = append(response.Ns, &dns.SOA{
+			Hdr: dns.RR_Header{
+				Name:   question.Name,
+				Rrtype: dns.TypeSOA,
+				Class:  dns.ClassINET,
+				Ttl:    ttl,
+			},
+			Ns:      question.Name,
+			Mbox:    question.Name,
+			Serial:  1,
+			Refresh: ttl,
+			Retry:   ttl,
+			Expire:  ttl,
+			Minttl:  ttl,
+		})
+	}
+
+	s.triggerAll(matched, question.Qtype, domain, []string{domain}, ipv4, ipv6, client_ip)
+
+	writeResponse(w, request, response)
+
+	return false
+}
@@ -0,0 +1,155 @@
+// dnsilly - dns automation utility
+// Copyright (C) 2025  bitrate16 (bitrate16@gmail.com)
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"dnsilly/config"
+	"net"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestBlockHandler(t *testing.T) {
+	tests := []struct {
+		action    string
+		qtype     uint16
+		rcode     int
+		addresses []string
+		soa       bool
+	}{
+		{action: ActionNXDomain, qtype: dns.TypeA, rcode: dns.RcodeNameError, soa: true},
+		{action: ActionNXDomain, qtype: dns.TypeMX, rcode: dns.RcodeNameError, soa: true},
+		{action: ActionRefused, qtype: dns.TypeA, rcode: dns.RcodeRefused},
+		{action: ActionNoData, qtype: dns.TypeA, rcode: dns.RcodeSuccess, soa: true},
+		{action: ActionNoData, qtype: dns.TypeAAAA, rcode: dns.RcodeSuccess, soa: true},
+		{action: ActionNull, qtype: dns.TypeA, rcode: dns.RcodeSuccess, addresses: []string{"0.0.0.0"}},
+		{action: ActionNull, qtype: dns.TypeAAAA, rcode: dns.RcodeSuccess, addresses: []string{"::"}},
+		{action: ActionNull, qtype: dns.TypeTXT, rcode: dns.RcodeSuccess, soa: true},
+		{action: ActionSinkhole, qtype: dns.TypeA, rcode: dns.RcodeSuccess, addresses: []string{"10.9.9.9"}},
+		{action: ActionSinkhole, qtype: dns.TypeAAAA, rcode: dns.RcodeSuccess, addresses: []string{"fd00::9"}},
+		{action: ActionSinkhole, qtype: dns.TypeMX, rcode: dns.RcodeSuccess, soa: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.action+" "+dns.TypeToString[test.qtype], func(t *testing.T) {
+			u := &testUpstream{addresses: []string{"10.0.0.1"}}
+			s := makeTestServer(t, u)
+			s.config.Block = &config.ConfigBlock{
+				Tags:         map[string]string{"log": test.action},
+				TTL:          5 * time.Minute,
+				SinkholeIPv4: "10.9.9.9",
+				SinkholeIPv6: "fd00::9",
+			}
+
+			request := &dns.Msg{}
+			request.SetQuestion("Ads.test.", test.qtype)
+
+			w := &testResponseWriter{remoteAddr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5353}}
+			if s.blockHandler(w, request) {
+				t.Fatal("blocked query passed to next handler")
+			}
+
+			response := w.msg
+			if response.Rcode != test.rcode || response.Id != request.Id || !response.Response {
+				t.Errorf("rcode = %s, id = %d", dns.RcodeToString[response.Rcode], response.Id)
+			}
+
+			addresses := make([]string, 0)
+			for _, answer := range response.Answer {
+				if answer.Header().Name != "Ads.test." || answer.Header().Ttl != 300 {
+					t.Errorf("unexpected answer %s", answer)
+				}
+				switch record := answer.(type) {
+				case *dns.A:
+					addresses = append(addresses, record.A.String())
+				case *dns.AAAA:
+					addresses = append(addresses, record.AAAA.String())
+				}
+			}
+			if !slices.Equal(addresses, test.addresses) {
+				t.Errorf("addresses = %v, want %v", addresses, test.addresses)
+			}
+
+			// Negative answers carry SOA for negative caching
+			if soa := len(response.Ns) == 1; soa != test.soa {
+				t.Fatalf("authority = %v, want soa %v", response.Ns, test.soa)
+			}
+			if test.soa {
+				soa, ok := response.Ns[0].(*dns.SOA)
+				if !ok || soa.Hdr.Name != "Ads.test." || soa.Hdr.Ttl != 300 || soa.Minttl != 300 {
+					t.Errorf("soa = %v", response.Ns[0])
+				}
+				if ttl, ok := negativeTTL(response); !ok || ttl != 300 {
+					t.Errorf("negative ttl = %d, %v", ttl, ok)
+				}
+			}
+
+			if u.exchanges.Load() != 0 {
+				t.Errorf("blocked query sent upstream")
+			}
+
+			// Triggers get blocked domain and local answer
+			observations := s.observations.List()
+			if len(observations) != 1 || observations[0].Domain != "ads.test" || observations[0].Qtype != test.qtype {
+				t.Fatalf("observations = %+v", observations)
+			}
+			if ips := slices.Concat(observations[0].Ipv4, observations[0].Ipv6); !slices.Equal(ips, test.addresses) {
+				t.Errorf("observed addresses = %v, want %v", ips, test.addresses)
+			}
+		})
+	}
+}
+
+func TestBlockHandlerPass(t *testing.T) {
+	s := makeTestServer(t, &testUpstream{})
+	s.config.Block = &config.ConfigBlock{Tags: map[string]string{"block": ActionNXDomain}}
+
+	// Matched rule of other tag and domain without rule pass through
+	for _, name := range []string{"ads.test.", "example.com."} {
+		request := &dns.Msg{}
+		request.SetQuestion(name, dns.TypeA)
+
+		w := &testResponseWriter{remoteAddr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5353}}
+		if !s.blockHandler(w, request) || w.msg != nil {
+			t.Errorf("%s: query answered by block handler", name)
+		}
+	}
+}
+
+func TestValidateBlock(t *testing.T) {
+	tests := []struct {
+		name string
+		conf *config.ConfigBlock
+		err  bool
+	}{
+		{name: "actions", conf: &config.ConfigBlock{Tags: map[string]string{"a": ActionNXDomain, "b": ActionRefused, "c": ActionNoData, "d": ActionNull}}},
+		{name: "sinkhole", conf: &config.ConfigBlock{Tags: map[string]string{"a": ActionSinkhole}, SinkholeIPv6: "fd00::9"}},
+		{name: "sinkhole without address", conf: &config.ConfigBlock{Tags: map[string]string{"a": ActionSinkhole}}, err: true},
+		{name: "unknown action", conf: &config.ConfigBlock{Tags: map[string]string{"a": "drop"}}, err: true},
+		{name: "ipv6 sinkhole for ipv4", conf: &config.ConfigBlock{SinkholeIPv4: "fd00::9"}, err: true},
+		{name: "invalid ipv6 sinkhole", conf: &config.ConfigBlock{SinkholeIPv6: "fd00::g"}, err: true},
+	}
+
+	for _, test := range tests {
+		if err := validateBlock(test.conf); (err != nil) != test.err {
+			t.Errorf("%s: error = %v, want error %v", test.name, err, test.err)
+		}
+	}
+}
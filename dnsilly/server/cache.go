@@ -0,0 +1,377 @@
+// dnsilly - dns automation utility
+// Copyright (C) 2025  bitrate16 (bitrate16@gmail.com)
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"container/list"
+	"dnsilly/config"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Cache key, name is lowercase
+type cacheKey struct {
+	name   string
+	qtype  uint16
+	qclass uint16
+}
+
+type cacheEntry struct {
+	key      cacheKey
+	response *dns.Msg
+	stored   time.Time
+	expires  time.Time
+
+	// Number of times served
+	hits int
+	// Refresh is in progress
+	prefetching bool
+}
+
+// LRU cache of upstream responses honoring record TTL
+type cache struct {
+	config *config.ConfigCache
+
+	entries map[cacheKey]*list.Element
+	// Least recently used at back
+	order *list.List
+	lock  sync.Mutex
+}
+
+func newCache(conf *config.ConfigCache) *cache {
+	return &cache{
+		config:  conf,
+		entries: make(map[cacheKey]*list.Element),
+		order:   list.New(),
+	}
+}
+
+func makeCacheKey(question dns.Question) cacheKey {
+	return cacheKey{
+		name:   strings.ToLower(question.Name),
+		qtype:  question.Qtype,
+		qclass: question.Qclass,
+	}
+}
+
+// Default TTL of stale answers as recommended by RFC 8767
+const defaultStaleTTL = 30 * time.Second
+
+// Default time expired answers are kept for serve-stale
+const defaultMaxStale = 24 * time.Hour
+
+// Remaining part of TTL at which popular entries are refreshed
+const prefetchRemainingRatio = 10
+
+// Time entry is kept after expiry
+func (c *cache) maxStale() time.Duration {
+	if !c.config.ServeStale {
+		return 0
+	}
+
+	if c.config.MaxStale == 0 {
+		return defaultMaxStale
+	}
+
+	return c.config.MaxStale
+}
+
+// TTL of stale answers in seconds
+func (c *cache) staleTTL() uint32 {
+	if c.config.StaleTTL == 0 {
+		return uint32(defaultStaleTTL.Seconds())
+	}
+
+	return uint32(c.config.StaleTTL.Seconds())
+}
+
+// Clamp TTL with configured limits
+func (c *cache) clampTTL(ttl uint32) uint32 {
+	if c.config.MinTTL != 0 && ttl < uint32(c.config.MinTTL.Seconds()) {
+		ttl = uint32(c.config.MinTTL.Seconds())
+	}
+
+	if c.config.MaxTTL != 0 && ttl > uint32(c.config.MaxTTL.Seconds()) {
+		ttl = uint32(c.config.MaxTTL.Seconds())
+	}
+
+	return ttl
+}
+
+// Records with TTL meaning, OPT pseudo-record has none
+func cacheableRecords(response *dns.Msg) []dns.RR {
+	records := make([]dns.RR, 0, len(response.Answer)+len(response.Ns)+len(response.Extra))
+	records = append(records, response.Answer...)
+	records = append(records, response.Ns...)
+	for _, rr := range response.Extra {
+		if rr.Header().Rrtype != dns.TypeOPT {
+			records = append(records, rr)
+		}
+	}
+
+	return records
+}
+
+// Remove OPT pseudo-record, EDNS of reply belongs to request it answers
+func stripOPT(response *dns.Msg) {
+	extra := make([]dns.RR, 0, len(response.Extra))
+	for _, rr := range response.Extra {
+		if rr.Header().Rrtype != dns.TypeOPT {
+			extra = append(extra, rr)
+		}
+	}
+
+	response.Extra = extra
+}
+
+// TTL for negative response as defined in RFC 2308, false if not cacheable
+func negativeTTL(response *dns.Msg) (uint32, bool) {
+	for _, rr := range response.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			return min(soa.Hdr.Ttl, soa.Minttl), true
+		}
+	}
+
+	return 0, false
+}
+
+// Store response, responses without TTL information are skipped
+func (c *cache) Set(request *dns.Msg, response *dns.Msg) {
+	if len(request.Question) != 1 || response.Truncated {
+		return
+	}
+
+	var ttl uint32
+	response = response.Copy()
+	stripOPT(response)
+	records := cacheableRecords(response)
+
+	switch {
+	case response.Rcode == dns.RcodeSuccess && len(response.Answer) != 0:
+		// Positive answer, expires with first record
+		for i, rr := range records {
+			rr.Header().Ttl = c.clampTTL(rr.Header().Ttl)
+			if i == 0 || rr.Header().Ttl < ttl {
+				ttl = rr.Header().Ttl
+			}
+		}
+	case response.Rcode == dns.RcodeSuccess || response.Rcode == dns.RcodeNameError:
+		// NXDOMAIN or NODATA
+		soaTTL, ok := negativeTTL(response)
+		if !ok {
+			return
+		}
+
+		ttl = c.clampTTL(soaTTL)
+		for _, rr := range records {
+			rr.Header().Ttl = min(rr.Header().Ttl, ttl)
+		}
+	default:
+		return
+	}
+
+	if ttl == 0 {
+		return
+	}
+
+	now := time.Now()
+	key := makeCacheKey(request.Question[0])
+	entry := &cacheEntry{
+		key:      key,
+		response: response,
+		stored:   now,
+		expires:  now.Add(time.Duration(ttl) * time.Second),
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if element, ok := c.entries[key]; ok {
+		entry.hits = element.Value.(*cacheEntry).hits
+		element.Value = entry
+		c.order.MoveToFront(element)
+		return
+	}
+
+	c.entries[key] = c.order.PushFront(entry)
+
+	// Evict least recently used
+	for c.config.MaxEntries > 0 && c.order.Len() > c.config.MaxEntries {
+		element := c.order.Back()
+		c.order.Remove(element)
+		delete(c.entries, element.Value.(*cacheEntry).key)
+	}
+}
+
+// Entries from most to least recently used, expired entries excluded
+func (c *cache) Entries() []*cacheEntry {
+	now := time.Now()
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	entries := make([]*cacheEntry, 0, c.order.Len())
+	for element := c.order.Front(); element != nil; element = element.Next() {
+		entry := element.Value.(*cacheEntry)
+		if now.Before(entry.expires.Add(c.maxStale())) {
+			entries = append(entries, entry)
+		}
+	}
+
+	return entries
+}
+
+// Add entries ordered from most to least recently used, expired entries are skipped
+func (c *cache) Restore(entries []*cacheEntry) {
+	now := time.Now()
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for _, entry := range entries {
+		if c.config.MaxEntries > 0 && c.order.Len() >= c.config.MaxEntries {
+			break
+		}
+
+		if _, ok := c.entries[entry.key]; ok || !now.Before(entry.expires.Add(c.maxStale())) {
+			continue
+		}
+
+		stripOPT(entry.response)
+		c.entries[entry.key] = c.order.PushBack(entry)
+	}
+}
+
+// Copy of cached response as reply to request
+func (c *cache) reply(request *dns.Msg, entry *cacheEntry, ttl func(uint32) uint32) *dns.Msg {
+	response := entry.response.Copy()
+	response.Id = request.Id
+	response.Question = request.Question
+
+	for _, rr := range cacheableRecords(response) {
+		rr.Header().Ttl = ttl(rr.Header().Ttl)
+	}
+
+	// EDNS only if request has it, with settings of request
+	if opt := request.IsEdns0(); opt != nil {
+		response.SetEdns0(opt.UDPSize(), opt.Do())
+	}
+
+	return response
+}
+
+// Cached response for request with decremented TTL, nil if none
+// Second value is true when entry should be refreshed by caller
+func (c *cache) Get(request *dns.Msg) (*dns.Msg, bool) {
+	if len(request.Question) != 1 {
+		return nil, false
+	}
+
+	key := makeCacheKey(request.Question[0])
+	now := time.Now()
+
+	c.lock.Lock()
+	element, ok := c.entries[key]
+	if !ok {
+		c.lock.Unlock()
+		return nil, false
+	}
+
+	entry := element.Value.(*cacheEntry)
+	if !now.Before(entry.expires) {
+		// Keep for serve-stale
+		if now.After(entry.expires.Add(c.maxStale())) {
+			c.order.Remove(element)
+			delete(c.entries, key)
+		}
+		c.lock.Unlock()
+		return nil, false
+	}
+	c.order.MoveToFront(element)
+	entry.hits += 1
+
+	// Refresh popular entries shortly before expiry
+	prefetch := false
+	if c.config.Prefetch && !entry.prefetching && entry.hits >= c.config.PrefetchHits {
+		lifetime := entry.expires.Sub(entry.stored)
+		if entry.expires.Sub(now) < lifetime/prefetchRemainingRatio {
+			entry.prefetching = true
+			prefetch = true
+		}
+	}
+	c.lock.Unlock()
+
+	// Reply to this request with remaining TTL
+	elapsed := uint32(now.Sub(entry.stored).Seconds())
+	response := c.reply(request, entry, func(ttl uint32) uint32 {
+		if ttl > elapsed {
+			return ttl - elapsed
+		}
+		return 0
+	})
+
+	return response, prefetch
+}
+
+// Expired response for request as defined in RFC 8767, nil if none
+func (c *cache) GetStale(request *dns.Msg) *dns.Msg {
+	if !c.config.ServeStale || len(request.Question) != 1 {
+		return nil
+	}
+
+	key := makeCacheKey(request.Question[0])
+
+	c.lock.Lock()
+	element, ok := c.entries[key]
+	if !ok {
+		c.lock.Unlock()
+		return nil
+	}
+
+	entry := element.Value.(*cacheEntry)
+	if time.Now().After(entry.expires.Add(c.maxStale())) {
+		c.order.Remove(element)
+		delete(c.entries, key)
+		c.lock.Unlock()
+		return nil
+	}
+	c.order.MoveToFront(element)
+	c.lock.Unlock()
+
+	// Stale answers are served with short TTL
+	staleTTL := c.staleTTL()
+	return c.reply(request, entry, func(ttl uint32) uint32 {
+		return min(ttl, staleTTL)
+	})
+}
+
+// Allow new refresh of entry after failed one
+func (c *cache) PrefetchFailed(request *dns.Msg) {
+	if len(request.Question) != 1 {
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if element, ok := c.entries[makeCacheKey(request.Question[0])]; ok {
+		element.Value.(*cacheEntry).prefetching = false
+	}
+}
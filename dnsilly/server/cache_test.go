@@ -0,0 +1,405 @@
+// dnsilly - dns automation utility
+// Copyright (C) 2025  bitrate16 (bitrate16@gmail.com)
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"dnsilly/config"
+	"net"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestCacheEDNS(t *testing.T) {
+	c := newCache(&config.ConfigCache{MaxEntries: 100})
+
+	// First client asks with DNSSEC OK and cookie, upstream answers with its own OPT
+	first := &dns.Msg{}
+	first.SetQuestion("edns.test.", dns.TypeA)
+	first.SetEdns0(1232, true)
+
+	upstreamResponse := makeTestResponse(first, dns.RcodeSuccess, "10.0.0.1")
+	upstreamResponse.SetEdns0(1232, true)
+	opt := upstreamResponse.IsEdns0()
+	opt.Option = append(opt.Option, &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: "0102030405060708aabbccddeeff0011"})
+
+	c.Set(first, upstreamResponse)
+
+	tests := []struct {
+		name    string
+		edns    bool
+		udpSize uint16
+		do      bool
+	}{
+		{name: "without edns"},
+		{name: "with edns", edns: true, udpSize: 4096},
+		{name: "with dnssec ok", edns: true, udpSize: 1400, do: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request := &dns.Msg{}
+			request.SetQuestion("edns.test.", dns.TypeA)
+			if test.edns {
+				request.SetEdns0(test.udpSize, test.do)
+			}
+
+			response, _ := c.Get(request)
+			if response == nil {
+				t.Fatal("response is not cached")
+			}
+
+			opt := response.IsEdns0()
+			if !test.edns {
+				if opt != nil {
+					t.Fatalf("reply to request without edns has OPT %s", opt)
+				}
+				return
+			}
+
+			if opt == nil {
+				t.Fatal("reply to request with edns has no OPT")
+			}
+			if opt.UDPSize() != test.udpSize || opt.Do() != test.do || len(opt.Option) != 0 {
+				t.Errorf("OPT = %s, want size %d, do %v without options", opt, test.udpSize, test.do)
+			}
+			if len(response.Answer) != 1 {
+				t.Errorf("answers = %d, want 1", len(response.Answer))
+			}
+		})
+	}
+}
+
+func TestCacheUnlimited(t *testing.T) {
+	c := newCache(&config.ConfigCache{MaxEntries: -1})
+
+	for i := range 200 {
+		request := &dns.Msg{}
+		request.SetQuestion(dns.Fqdn(strconv.Itoa(i)+".test"), dns.TypeA)
+		c.Set(request, makeTestResponse(request, dns.RcodeSuccess, "10.0.0.1"))
+	}
+
+	if entries := len(c.Entries()); entries != 200 {
+		t.Errorf("entries = %d, want 200", entries)
+	}
+}
+
+// Move cached entry to the past as if time elapsed since it was stored
+func ageCacheEntry(c *cache, request *dns.Msg, elapsed time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	entry := c.entries[makeCacheKey(request.Question[0])].Value.(*cacheEntry)
+	entry.stored = entry.stored.Add(-elapsed)
+	entry.expires = entry.expires.Add(-elapsed)
+}
+
+// Response with records of given TTLs
+func makeTTLResponse(request *dns.Msg, ttls ...uint32) *dns.Msg {
+	response := makeTestResponse(request, dns.RcodeSuccess)
+	for i, ttl := range ttls {
+		response.Answer = append(response.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: request.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ttl},
+			A:   net.IPv4(10, 0, 0, byte(i+1)),
+		})
+	}
+
+	return response
+}
+
+// Negative response with SOA in authority section
+func makeNegativeResponse(request *dns.Msg, rcode int, soaTTL uint32, minTTL uint32) *dns.Msg {
+	response := makeTestResponse(request, rcode)
+	response.Ns = append(response.Ns, &dns.SOA{
+		Hdr:     dns.RR_Header{Name: "test.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: soaTTL},
+		Ns:      "ns.test.",
+		Mbox:    "hostmaster.test.",
+		Serial:  1,
+		Refresh: 3600,
+		Retry:   600,
+		Expire:  86400,
+		Minttl:  minTTL,
+	})
+
+	return response
+}
+
+// TTLs of all records with TTL meaning
+func recordTTLs(response *dns.Msg) []uint32 {
+	ttls := make([]uint32, 0)
+	for _, rr := range cacheableRecords(response) {
+		ttls = append(ttls, rr.Header().Ttl)
+	}
+
+	return ttls
+}
+
+func TestCacheTTL(t *testing.T) {
+	tests := []struct {
+		name     string
+		minTTL   time.Duration
+		maxTTL   time.Duration
+		response func(request *dns.Msg) *dns.Msg
+
+		// Record TTLs of reply, nil if not cached
+		ttls []uint32
+		// Lifetime of entry
+		lifetime time.Duration
+	}{
+		{
+			name:     "record ttl",
+			response: func(r *dns.Msg) *dns.Msg { return makeTTLResponse(r, 300) },
+			ttls:     []uint32{300},
+			lifetime: 300 * time.Second,
+		},
+		{
+			name:     "expires with first record",
+			response: func(r *dns.Msg) *dns.Msg { return makeTTLResponse(r, 300, 60, 120) },
+			ttls:     []uint32{300, 60, 120},
+			lifetime: 60 * time.Second,
+		},
+		{
+			name:     "raised to min ttl",
+			minTTL:   time.Minute,
+			response: func(r *dns.Msg) *dns.Msg { return makeTTLResponse(r, 10, 300) },
+			ttls:     []uint32{60, 300},
+			lifetime: 60 * time.Second,
+		},
+		{
+			name:     "lowered to max ttl",
+			maxTTL:   2 * time.Minute,
+			response: func(r *dns.Msg) *dns.Msg { return makeTTLResponse(r, 3600, 60) },
+			ttls:     []uint32{120, 60},
+			lifetime: 60 * time.Second,
+		},
+		{
+			name:     "zero ttl",
+			response: func(r *dns.Msg) *dns.Msg { return makeTTLResponse(r, 0) },
+		},
+		{
+			name:     "zero ttl raised to min ttl",
+			minTTL:   30 * time.Second,
+			response: func(r *dns.Msg) *dns.Msg { return makeTTLResponse(r, 0) },
+			ttls:     []uint32{30},
+			lifetime: 30 * time.Second,
+		},
+		{
+			name:     "nxdomain expires with soa minimum",
+			response: func(r *dns.Msg) *dns.Msg { return makeNegativeResponse(r, dns.RcodeNameError, 3600, 300) },
+			ttls:     []uint32{300},
+			lifetime: 300 * time.Second,
+		},
+		{
+			name:     "nodata expires with soa ttl",
+			response: func(r *dns.Msg) *dns.Msg { return makeNegativeResponse(r, dns.RcodeSuccess, 60, 900) },
+			ttls:     []uint32{60},
+			lifetime: 60 * time.Second,
+		},
+		{
+			name:     "negative ttl lowered to max ttl",
+			maxTTL:   time.Minute,
+			response: func(r *dns.Msg) *dns.Msg { return makeNegativeResponse(r, dns.RcodeNameError, 3600, 600) },
+			ttls:     []uint32{60},
+			lifetime: 60 * time.Second,
+		},
+		{
+			name:     "nxdomain without soa",
+			response: func(r *dns.Msg) *dns.Msg { return makeTestResponse(r, dns.RcodeNameError) },
+		},
+		{
+			name:     "servfail",
+			response: func(r *dns.Msg) *dns.Msg { return makeNegativeResponse(r, dns.RcodeServerFailure, 60, 60) },
+		},
+		{
+			name: "truncated",
+			response: func(r *dns.Msg) *dns.Msg {
+				response := makeTTLResponse(r, 300)
+				response.Truncated = true
+				return response
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := newCache(&config.ConfigCache{MaxEntries: 100, MinTTL: test.minTTL, MaxTTL: test.maxTTL})
+
+			request := &dns.Msg{}
+			request.SetQuestion("ttl.test.", dns.TypeA)
+
+			response := test.response(request)
+			original := recordTTLs(response)
+			c.Set(request, response)
+
+			// Upstream response is not modified
+			if ttls := recordTTLs(response); !slices.Equal(ttls, original) {
+				t.Errorf("upstream ttls = %v, want %v", ttls, original)
+			}
+
+			cached, _ := c.Get(request)
+			if test.ttls == nil {
+				if cached != nil {
+					t.Fatalf("response cached with ttls %v", recordTTLs(cached))
+				}
+				return
+			}
+			if cached == nil {
+				t.Fatal("response is not cached")
+			}
+
+			if ttls := recordTTLs(cached); !slices.Equal(ttls, test.ttls) {
+				t.Errorf("ttls = %v, want %v", ttls, test.ttls)
+			}
+			if cached.Rcode != response.Rcode {
+				t.Errorf("rcode = %s, want %s", dns.RcodeToString[cached.Rcode], dns.RcodeToString[response.Rcode])
+			}
+
+			entry := c.Entries()[0]
+			if lifetime := entry.expires.Sub(entry.stored); lifetime != test.lifetime {
+				t.Errorf("lifetime = %v, want %v", lifetime, test.lifetime)
+			}
+		})
+	}
+}
+
+func TestCacheTTLDecrement(t *testing.T) {
+	c := newCache(&config.ConfigCache{MaxEntries: 100, ServeStale: true, StaleTTL: 10 * time.Second})
+
+	request := &dns.Msg{}
+	request.SetQuestion("ttl.test.", dns.TypeA)
+	c.Set(request, makeTTLResponse(request, 300, 120))
+
+	steps := []struct {
+		elapsed time.Duration
+		ttls    []uint32
+		stale   []uint32
+	}{
+		{elapsed: 0, ttls: []uint32{300, 120}},
+		{elapsed: 100 * time.Second, ttls: []uint32{200, 20}},
+		{elapsed: 19 * time.Second, ttls: []uint32{181, 1}},
+
+		// Expired with first record, stale answer has short TTL
+		{elapsed: time.Second, stale: []uint32{10, 10}},
+	}
+
+	for _, step := range steps {
+		ageCacheEntry(c, request, step.elapsed)
+
+		response, _ := c.Get(request)
+		if step.ttls == nil {
+			if response != nil {
+				t.Fatalf("expired response served with ttls %v", recordTTLs(response))
+			}
+
+			stale := c.GetStale(request)
+			if stale == nil {
+				t.Fatal("stale response is not served")
+			}
+			if ttls := recordTTLs(stale); !slices.Equal(ttls, step.stale) {
+				t.Errorf("stale ttls = %v, want %v", ttls, step.stale)
+			}
+			continue
+		}
+
+		if response == nil {
+			t.Fatalf("response is not cached after %v", step.elapsed)
+		}
+		if ttls := recordTTLs(response); !slices.Equal(ttls, step.ttls) {
+			t.Errorf("ttls = %v, want %v", ttls, step.ttls)
+		}
+	}
+}
+
+func TestCacheLRU(t *testing.T) {
+	c := newCache(&config.ConfigCache{MaxEntries: 2})
+
+	requests := make(map[string]*dns.Msg)
+	set := func(name string) {
+		request := &dns.Msg{}
+		request.SetQuestion(name, dns.TypeA)
+		requests[name] = request
+		c.Set(request, makeTTLResponse(request, 300))
+	}
+	cached := func() []string {
+		names := make([]string, 0)
+		for _, entry := range c.Entries() {
+			names = append(names, entry.key.name)
+		}
+		return names
+	}
+
+	set("a.test.")
+	set("b.test.")
+	if names := cached(); !slices.Equal(names, []string{"b.test.", "a.test."}) {
+		t.Fatalf("cached = %v", names)
+	}
+
+	// Hit makes entry most recently used
+	if response, _ := c.Get(requests["a.test."]); response == nil {
+		t.Fatal("a.test is not cached")
+	}
+
+	set("c.test.")
+	if names := cached(); !slices.Equal(names, []string{"c.test.", "a.test."}) {
+		t.Fatalf("cached after eviction = %v", names)
+	}
+	if response, _ := c.Get(requests["b.test."]); response != nil {
+		t.Error("least recently used entry is not evicted")
+	}
+
+	// Update of cached entry does not evict
+	set("a.test.")
+	if names := cached(); !slices.Equal(names, []string{"a.test.", "c.test."}) {
+		t.Fatalf("cached after update = %v", names)
+	}
+
+	// Names are matched case insensitively
+	request := &dns.Msg{}
+	request.SetQuestion("C.Test.", dns.TypeA)
+	if response, _ := c.Get(request); response == nil || response.Question[0].Name != "C.Test." {
+		t.Errorf("response to mixed case query = %v", response)
+	}
+}
+
+func TestProxyCacheHit(t *testing.T) {
+	u := &testUpstream{addresses: []string{"10.0.0.1"}}
+	s := makeTestServer(t, u)
+
+	request := &dns.Msg{}
+	request.SetQuestion("hit.test.", dns.TypeA)
+
+	w := &testResponseWriter{remoteAddr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5353}}
+	s.proxyHandler(w, request)
+
+	ageCacheEntry(s.cache, request, 15*time.Second)
+
+	request.Id = 4242
+	s.proxyHandler(w, request)
+
+	if u.exchanges.Load() != 1 {
+		t.Errorf("upstream exchanges = %d, want 1", u.exchanges.Load())
+	}
+	if w.msg.Id != 4242 || !slices.Equal(testAddresses(w.msg), []string{"10.0.0.1"}) {
+		t.Errorf("cached reply id = %d, addresses = %v", w.msg.Id, testAddresses(w.msg))
+	}
+	if ttls := recordTTLs(w.msg); !slices.Equal(ttls, []uint32{45}) {
+		t.Errorf("ttls = %v, want [45]", ttls)
+	}
+}
@@ -0,0 +1,190 @@
+// dnsilly - dns automation utility
+// Copyright (C) 2025  bitrate16 (bitrate16@gmail.com)
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"dnsilly/util"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/netip"
+
+	"github.com/miekg/dns"
+)
+
+const dohContentType = "application/dns-message"
+
+// Response writer capturing reply of handler chain for DNS-over-HTTPS
+type dohResponseWriter struct {
+	localAddr  net.Addr
+	remoteAddr net.Addr
+	response   *dns.Msg
+}
+
+func (w *dohResponseWriter) LocalAddr() net.Addr {
+	return w.localAddr
+}
+
+func (w *dohResponseWriter) RemoteAddr() net.Addr {
+	return w.remoteAddr
+}
+
+func (w *dohResponseWriter) WriteMsg(m *dns.Msg) error {
+	w.response = m
+	return nil
+}
+
+func (w *dohResponseWriter) Write(b []byte) (int, error) {
+	m := &dns.Msg{}
+	err := m.Unpack(b)
+	if err != nil {
+		return 0, err
+	}
+
+	w.response = m
+	return len(b), nil
+}
+
+func (w *dohResponseWriter) Close() error {
+	return nil
+}
+
+func (w *dohResponseWriter) TsigStatus() error {
+	return nil
+}
+
+func (w *dohResponseWriter) TsigTimersOnly(bool) {}
+
+func (w *dohResponseWriter) Hijack() {}
+
+// Parse "ip:port" address of http request without name resolution
+func parseHTTPAddr(addr string) net.Addr {
+	addrPort, err := netip.ParseAddrPort(addr)
+	if err != nil {
+		return &net.TCPAddr{}
+	}
+
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(addrPort.Addr().Unmap(), addrPort.Port()))
+}
+
+// Address of listener that accepted http request
+func httpLocalAddr(r *http.Request) net.Addr {
+	if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		return addr
+	}
+
+	return &net.TCPAddr{}
+}
+
+// Read DNS message from GET or POST request as defined in RFC 8484
+func readDoHRequest(r *http.Request) (*dns.Msg, error) {
+	var data []byte
+	var err error
+
+	switch r.Method {
+	case http.MethodGet:
+		data, err = base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+		if err != nil {
+			return nil, err
+		}
+	case http.MethodPost:
+		// Parameters such as charset are allowed
+		mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if err != nil || mediaType != dohContentType {
+			return nil, fmt.Errorf("unsupported content type: %s", r.Header.Get("Content-Type"))
+		}
+
+		data, err = io.ReadAll(io.LimitReader(r.Body, dns.MaxMsgSize))
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported method: %s", r.Method)
+	}
+
+	if len(data) == 0 {
+		return nil, errors.New("empty dns message")
+	}
+
+	request := &dns.Msg{}
+	err = request.Unpack(data)
+	if err != nil {
+		return nil, err
+	}
+
+	return request, nil
+}
+
+// HTTP freshness lifetime of response as defined in RFC 8484 section 5.1:
+// smallest answer TTL, SOA minimum for negative responses, 0 if unknown
+func dohMaxAge(response *dns.Msg) uint32 {
+	if len(response.Answer) == 0 {
+		ttl, _ := negativeTTL(response)
+		return ttl
+	}
+
+	ttl := response.Answer[0].Header().Ttl
+	for _, rr := range response.Answer[1:] {
+		ttl = min(ttl, rr.Header().Ttl)
+	}
+
+	return ttl
+}
+
+// Serve DNS-over-HTTPS requests with handler chain
+type dohHandler struct {
+	chain HandlerChain
+}
+
+func (h *dohHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	request, err := readDoHRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	writer := &dohResponseWriter{
+		localAddr:  httpLocalAddr(r),
+		remoteAddr: parseHTTPAddr(r.RemoteAddr),
+	}
+	h.chain.ServeDNS(writer, request)
+
+	if writer.response == nil {
+		http.Error(w, "no response", http.StatusInternalServerError)
+		return
+	}
+
+	data, err := writer.response.Pack()
+	if err != nil {
+		fmt.Printf("[%s] Error while packing DoH response: %v\n", util.Now(), err)
+		http.Error(w, "invalid response", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", dohContentType)
+	w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", dohMaxAge(writer.response)))
+	w.Write(data)
+}
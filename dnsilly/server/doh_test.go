@@ -0,0 +1,228 @@
+// dnsilly - dns automation utility
+// Copyright (C) 2025  bitrate16 (bitrate16@gmail.com)
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestParseHTTPAddr(t *testing.T) {
+	tests := []struct {
+		addr string
+		want string
+	}{
+		{"127.0.0.1:5353", "127.0.0.1:5353"},
+		{"[::1]:443", "[::1]:443"},
+		{"[::ffff:10.0.0.1]:443", "10.0.0.1:443"},
+		{"localhost:443", ":0"},
+		{"dns.test:443", ":0"},
+		{"invalid", ":0"},
+	}
+
+	for _, test := range tests {
+		if got := parseHTTPAddr(test.addr).String(); got != test.want {
+			t.Errorf("%s: got %s, want %s", test.addr, got, test.want)
+		}
+	}
+}
+
+// Addresses seen by handler chain of DoH server
+type dohTestChain struct {
+	localAddr  net.Addr
+	remoteAddr net.Addr
+}
+
+func (c *dohTestChain) chain() HandlerChain {
+	chain := NewHandlerChain()
+	chain.Add(func(w dns.ResponseWriter, r *dns.Msg) bool {
+		c.localAddr = w.LocalAddr()
+		c.remoteAddr = w.RemoteAddr()
+
+		response := &dns.Msg{}
+		response.SetReply(r)
+		response.Answer = append(response.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   net.IPv4(10, 0, 0, 1),
+		})
+		w.WriteMsg(response)
+
+		return false
+	})
+
+	return chain
+}
+
+func TestDoHHandler(t *testing.T) {
+	request := &dns.Msg{}
+	request.SetQuestion("doh.test.", dns.TypeA)
+	packed, err := request.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		query  string
+		body   []byte
+		ctype  string
+		status int
+	}{
+		{
+			name:   "get",
+			method: http.MethodGet,
+			query:  "?dns=" + base64.RawURLEncoding.EncodeToString(packed),
+			status: http.StatusOK,
+		},
+		{
+			name:   "post",
+			method: http.MethodPost,
+			body:   packed,
+			ctype:  dohContentType,
+			status: http.StatusOK,
+		},
+		{
+			name:   "post with charset",
+			method: http.MethodPost,
+			body:   packed,
+			ctype:  dohContentType + "; charset=utf-8",
+			status: http.StatusOK,
+		},
+		{
+			name:   "post with mixed case content type",
+			method: http.MethodPost,
+			body:   packed,
+			ctype:  "Application/DNS-Message",
+			status: http.StatusOK,
+		},
+		{
+			name:   "post with invalid content type",
+			method: http.MethodPost,
+			body:   packed,
+			ctype:  dohContentType + "; charset",
+			status: http.StatusBadRequest,
+		},
+		{
+			name:   "get without message",
+			method: http.MethodGet,
+			status: http.StatusBadRequest,
+		},
+		{
+			name:   "post with other content type",
+			method: http.MethodPost,
+			body:   packed,
+			ctype:  "text/plain",
+			status: http.StatusBadRequest,
+		},
+		{
+			name:   "put",
+			method: http.MethodPut,
+			body:   packed,
+			ctype:  dohContentType,
+			status: http.StatusMethodNotAllowed,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			seen := &dohTestChain{}
+			server := httptest.NewTLSServer(&dohHandler{chain: seen.chain()})
+			defer server.Close()
+
+			httpRequest, err := http.NewRequest(test.method, server.URL+"/dns-query"+test.query, bytes.NewReader(test.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.ctype != "" {
+				httpRequest.Header.Set("Content-Type", test.ctype)
+			}
+
+			httpResponse, err := server.Client().Do(httpRequest)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer httpResponse.Body.Close()
+
+			if httpResponse.StatusCode != test.status {
+				t.Fatalf("status = %d, want %d", httpResponse.StatusCode, test.status)
+			}
+			if test.status != http.StatusOK {
+				return
+			}
+
+			if ctype := httpResponse.Header.Get("Content-Type"); ctype != dohContentType {
+				t.Errorf("content type = %s", ctype)
+			}
+			if cacheControl := httpResponse.Header.Get("Cache-Control"); cacheControl != "max-age=60" {
+				t.Errorf("cache control = %s", cacheControl)
+			}
+
+			data, err := io.ReadAll(httpResponse.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			response := &dns.Msg{}
+			if err := response.Unpack(data); err != nil {
+				t.Fatal(err)
+			}
+			if response.Id != request.Id || len(response.Answer) != 1 {
+				t.Errorf("unexpected response %s", response)
+			}
+
+			// Listener address and client address without name resolution
+			if seen.localAddr.String() != server.Listener.Addr().String() {
+				t.Errorf("local addr = %s, want %s", seen.localAddr, server.Listener.Addr())
+			}
+			remoteAddr, ok := seen.remoteAddr.(*net.TCPAddr)
+			if !ok || !remoteAddr.IP.IsLoopback() || remoteAddr.Port == 0 {
+				t.Errorf("remote addr = %s", seen.remoteAddr)
+			}
+		})
+	}
+}
+
+func TestDoHMaxAge(t *testing.T) {
+	request := &dns.Msg{}
+	request.SetQuestion("doh.test.", dns.TypeA)
+
+	tests := []struct {
+		name     string
+		response *dns.Msg
+		want     uint32
+	}{
+		{name: "smallest answer ttl", response: makeTTLResponse(request, 300, 45, 120), want: 45},
+		{name: "zero answer ttl", response: makeTTLResponse(request, 0, 300), want: 0},
+		{name: "nxdomain", response: makeNegativeResponse(request, dns.RcodeNameError, 3600, 300), want: 300},
+		{name: "nodata", response: makeNegativeResponse(request, dns.RcodeSuccess, 60, 900), want: 60},
+		{name: "refused", response: makeTestResponse(request, dns.RcodeRefused), want: 0},
+	}
+
+	for _, test := range tests {
+		if got := dohMaxAge(test.response); got != test.want {
+			t.Errorf("%s: max age = %d, want %d", test.name, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,197 @@
+// dnsilly - dns automation utility
+// Copyright (C) 2025  bitrate16 (bitrate16@gmail.com)
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"dnsilly/config"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Max idle connections kept per DNS-over-TLS upstream
+const dotMaxIdleConns = 8
+
+// Build TLS config for encrypted upstream
+func makeUpstreamTLSConfig(conf *config.ConfigUpstream, host string) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		ServerName: host,
+	}
+
+	if conf.ServerName != "" {
+		tlsConfig.ServerName = conf.ServerName
+	}
+
+	if conf.CAFile != "" {
+		data, err := os.ReadFile(conf.CAFile)
+		if err != nil {
+			return nil, err
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificates found in %s", conf.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if conf.SPKIPin != "" {
+		pin, err := base64.StdEncoding.DecodeString(conf.SPKIPin)
+		if err != nil {
+			return nil, fmt.Errorf("invalid spki pin: %v", err)
+		}
+		if len(pin) != sha256.Size {
+			return nil, errors.New("invalid spki pin: expected sha256 digest")
+		}
+
+		// Pin alone is trusted without CA validation
+		if conf.CAFile == "" {
+			tlsConfig.InsecureSkipVerify = true
+		}
+
+		// Unverified chain may carry any certificate, only leaf proves key possession
+		verified := conf.CAFile != ""
+		tlsConfig.VerifyConnection = func(state tls.ConnectionState) error {
+			return verifyPin(state, pin, verified)
+		}
+	}
+
+	return tlsConfig, nil
+}
+
+// Check SPKI pin against leaf certificate or any certificate of verified chains
+func verifyPin(state tls.ConnectionState, pin []byte, verified bool) error {
+	certs := make([]*x509.Certificate, 0)
+	if verified {
+		for _, chain := range state.VerifiedChains {
+			certs = append(certs, chain...)
+		}
+	} else if len(state.PeerCertificates) != 0 {
+		certs = append(certs, state.PeerCertificates[0])
+	}
+
+	for _, cert := range certs {
+		digest := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+		if string(digest[:]) == string(pin) {
+			return nil
+		}
+	}
+
+	return errors.New("spki pin mismatch")
+}
+
+// DNS-over-TLS as defined in RFC 7858, connections are reused between queries
+type dotUpstream struct {
+	addr   string
+	client *dns.Client
+
+	// Idle connections
+	conns []*dns.Conn
+	lock  sync.Mutex
+}
+
+func newDoTUpstream(addr string, tlsConfig *tls.Config, timeout time.Duration) *dotUpstream {
+	if timeout == 0 {
+		timeout = defaultUpstreamTimeout
+	}
+
+	return &dotUpstream{
+		addr: addr,
+		client: &dns.Client{
+			Net:       "tcp-tls",
+			TLSConfig: tlsConfig,
+			Timeout:   timeout,
+		},
+		conns: make([]*dns.Conn, 0),
+	}
+}
+
+func (u *dotUpstream) String() string {
+	return "tls://" + u.addr
+}
+
+func (u *dotUpstream) Close() {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	for _, conn := range u.conns {
+		conn.Close()
+	}
+	u.conns = u.conns[:0]
+}
+
+// Take idle connection, nil if none
+func (u *dotUpstream) take() *dns.Conn {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	if len(u.conns) == 0 {
+		return nil
+	}
+
+	conn := u.conns[len(u.conns)-1]
+	u.conns = u.conns[:len(u.conns)-1]
+
+	return conn
+}
+
+// Return connection to idle list
+func (u *dotUpstream) release(conn *dns.Conn) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	if len(u.conns) >= dotMaxIdleConns {
+		conn.Close()
+		return
+	}
+
+	u.conns = append(u.conns, conn)
+}
+
+func (u *dotUpstream) Exchange(request *dns.Msg) (*dns.Msg, error) {
+	// Idle connection may be closed by server, retry with new one
+	if conn := u.take(); conn != nil {
+		response, _, err := u.client.ExchangeWithConn(request, conn)
+		if err == nil {
+			u.release(conn)
+			return response, nil
+		}
+		conn.Close()
+	}
+
+	conn, err := u.client.Dial(u.addr)
+	if err != nil {
+		return nil, err
+	}
+
+	response, _, err := u.client.ExchangeWithConn(request, conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	u.release(conn)
+
+	return response, nil
+}
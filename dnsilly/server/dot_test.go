@@ -0,0 +1,220 @@
+// dnsilly - dns automation utility
+// Copyright (C) 2025  bitrate16 (bitrate16@gmail.com)
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"dnsilly/config"
+	"encoding/base64"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const testServerName = "dns.test"
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+// Make certificate signed by parent, self-signed if parent is nil
+func makeTestCert(t *testing.T, name string, isCA bool, parent *testCert) *testCert {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		DNSNames:              []string{testServerName},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  isCA,
+	}
+
+	signer, signerKey := template, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+
+	raw, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := x509.ParseCertificate(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &testCert{cert: cert, key: key}
+}
+
+// Server certificate presenting chain with key of first certificate
+func (c *testCert) tlsCertificate(chain ...*testCert) tls.Certificate {
+	certificate := tls.Certificate{
+		Certificate: [][]byte{c.cert.Raw},
+		PrivateKey:  c.key,
+	}
+	for _, extra := range chain {
+		certificate.Certificate = append(certificate.Certificate, extra.cert.Raw)
+	}
+
+	return certificate
+}
+
+func (c *testCert) pin() string {
+	digest := sha256.Sum256(c.cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(digest[:])
+}
+
+func (c *testCert) writePEM(t *testing.T) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "ca.pem")
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.cert.Raw})
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+// Handshake client config with server presenting given certificate
+func testHandshake(t *testing.T, clientConfig *tls.Config, serverCert tls.Certificate) error {
+	t.Helper()
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		conn.(*tls.Conn).Handshake()
+		conn.Close()
+	}()
+
+	dialer := &net.Dialer{Timeout: 5 * time.Second}
+	conn, err := tls.DialWithDialer(dialer, "tcp", listener.Addr().String(), clientConfig)
+	if err != nil {
+		return err
+	}
+	conn.Close()
+
+	return nil
+}
+
+func TestUpstreamSPKIPin(t *testing.T) {
+	root := makeTestCert(t, "root", true, nil)
+	leaf := makeTestCert(t, "leaf", false, root)
+	pinned := makeTestCert(t, "pinned", false, nil)
+	attacker := makeTestCert(t, "attacker", false, nil)
+
+	caFile := root.writePEM(t)
+
+	tests := []struct {
+		name    string
+		conf    *config.ConfigUpstream
+		server  tls.Certificate
+		success bool
+	}{
+		{
+			name:    "pinned leaf",
+			conf:    &config.ConfigUpstream{SPKIPin: pinned.pin()},
+			server:  pinned.tlsCertificate(),
+			success: true,
+		},
+		{
+			name:    "other leaf",
+			conf:    &config.ConfigUpstream{SPKIPin: pinned.pin()},
+			server:  attacker.tlsCertificate(),
+			success: false,
+		},
+		{
+			name:    "other leaf with pinned certificate appended",
+			conf:    &config.ConfigUpstream{SPKIPin: pinned.pin()},
+			server:  attacker.tlsCertificate(pinned),
+			success: false,
+		},
+		{
+			name:    "pinned ca in verified chain",
+			conf:    &config.ConfigUpstream{SPKIPin: root.pin(), CAFile: caFile},
+			server:  leaf.tlsCertificate(),
+			success: true,
+		},
+		{
+			name:    "pinned leaf in verified chain",
+			conf:    &config.ConfigUpstream{SPKIPin: leaf.pin(), CAFile: caFile},
+			server:  leaf.tlsCertificate(),
+			success: true,
+		},
+		{
+			name:    "pinned certificate outside verified chain",
+			conf:    &config.ConfigUpstream{SPKIPin: pinned.pin(), CAFile: caFile},
+			server:  leaf.tlsCertificate(pinned),
+			success: false,
+		},
+		{
+			name:    "untrusted chain with pinned leaf",
+			conf:    &config.ConfigUpstream{SPKIPin: attacker.pin(), CAFile: caFile},
+			server:  attacker.tlsCertificate(),
+			success: false,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tlsConfig, err := makeUpstreamTLSConfig(test.conf, testServerName)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = testHandshake(t, tlsConfig, test.server)
+			if test.success && err != nil {
+				t.Errorf("handshake failed: %v", err)
+			}
+			if !test.success && err == nil {
+				t.Error("handshake succeeded")
+			}
+		})
+	}
+}
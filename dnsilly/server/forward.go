@@ -0,0 +1,95 @@
+// dnsilly - dns automation utility
+// Copyright (C) 2025  bitrate16 (bitrate16@gmail.com)
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"dnsilly/rules"
+	"dnsilly/util"
+	"fmt"
+
+	"github.com/miekg/dns"
+)
+
+// Make default upstream pool, upstream groups and forwarding rules from config
+func (s *Server) setupUpstreams() error {
+	pool, err := makeUpstreamPool(s.config.Strategy, s.config.Upstreams, s.config.Verbose)
+	if err != nil {
+		return err
+	}
+
+	groups := make(map[string]*upstreamPool)
+	for name, groupConf := range s.config.UpstreamGroups {
+		if groupConf == nil {
+			return fmt.Errorf("upstream group %s is empty", name)
+		}
+
+		groups[name], err = makeUpstreamPool(groupConf.Strategy, groupConf.Upstreams, s.config.Verbose)
+		if err != nil {
+			return fmt.Errorf("upstream group %s: %v", name, err)
+		}
+	}
+
+	forwardRules := make([]*rules.Rule, 0, len(s.config.Forward))
+	for _, forwardConf := range s.config.Forward {
+		if _, ok := groups[forwardConf.Group]; !ok {
+			return fmt.Errorf("forward %s: unknown upstream group %s", forwardConf.Pattern, forwardConf.Group)
+		}
+
+		rule, err := rules.NewRule(forwardConf.Group, forwardConf.Pattern)
+		if err != nil {
+			return fmt.Errorf("forward %s: %v", forwardConf.Pattern, err)
+		}
+		forwardRules = append(forwardRules, rule)
+	}
+
+	s.upstreams = pool
+	s.groups = groups
+	s.forward = rules.NewRules(forwardRules)
+
+	return nil
+}
+
+// All upstream pools, default one first
+func (s *Server) pools() []*upstreamPool {
+	pools := make([]*upstreamPool, 0, len(s.groups)+1)
+	pools = append(pools, s.upstreams)
+	for _, pool := range s.groups {
+		pools = append(pools, pool)
+	}
+
+	return pools
+}
+
+// Select upstream pool by query name
+func (s *Server) selectPool(request *dns.Msg) *upstreamPool {
+	if len(request.Question) == 0 {
+		return s.upstreams
+	}
+
+	domain := normalizeDomain(request.Question[0].Name)
+	matched := s.forward.Match([]byte(domain), request.Question[0].Qtype, nil)
+	if len(matched) == 0 {
+		return s.upstreams
+	}
+	rule := matched[0]
+
+	if s.config.Verbose {
+		fmt.Printf("[%s] Forward %s to upstream group %s\n", util.Now(), domain, rule.Tag)
+	}
+
+	return s.groups[rule.Tag]
+}
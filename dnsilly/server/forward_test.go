@@ -0,0 +1,173 @@
+// dnsilly - dns automation utility
+// Copyright (C) 2025  bitrate16 (bitrate16@gmail.com)
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"dnsilly/config"
+	"dnsilly/rules"
+	"net"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestSelectPool(t *testing.T) {
+	s := makeTestServer(t, &testUpstream{addresses: []string{"10.0.0.1"}})
+
+	groups := map[string]*upstreamPool{
+		"corp":   makeTestPool(t, StrategySequential, &testUpstream{addresses: []string{"10.1.0.1"}}),
+		"lan":    makeTestPool(t, StrategySequential, &testUpstream{addresses: []string{"10.2.0.1"}}),
+		"mirror": makeTestPool(t, StrategySequential, &testUpstream{addresses: []string{"10.3.0.1"}}),
+	}
+
+	forward := make([]*rules.Rule, 0)
+	for _, conf := range []*config.ConfigForward{
+		{Pattern: "exact:vpn.corp.test", Group: "lan"},
+		{Pattern: "+.corp.test", Group: "corp"},
+		{Pattern: "*.lan", Group: "lan"},
+		{Pattern: "regex:/^mirror[0-9]+\\.test$/", Group: "mirror"},
+	} {
+		rule, err := rules.NewRule(conf.Group, conf.Pattern)
+		if err != nil {
+			t.Fatal(err)
+		}
+		forward = append(forward, rule)
+	}
+
+	s.groups = groups
+	s.forward = rules.NewRules(forward)
+
+	tests := []struct {
+		name  string
+		group string
+	}{
+		{name: "corp.test.", group: "corp"},
+		{name: "www.corp.test.", group: "corp"},
+		{name: "WWW.Corp.TEST.", group: "corp"},
+		{name: "vpn.corp.test.", group: "lan"},
+		{name: "printer.lan.", group: "lan"},
+		{name: "lan."},
+		{name: "mirror1.test.", group: "mirror"},
+		{name: "mirror.test."},
+		{name: "notcorp.test."},
+		{name: "example.com."},
+	}
+
+	for _, test := range tests {
+		request := &dns.Msg{}
+		request.SetQuestion(test.name, dns.TypeA)
+
+		want := s.upstreams
+		if test.group != "" {
+			want = groups[test.group]
+		}
+		if pool := s.selectPool(request); pool != want {
+			t.Errorf("%s: selected %v, want group %q", test.name, pool.upstreams[0], test.group)
+		}
+	}
+
+	// Query without question goes to default pool
+	if pool := s.selectPool(&dns.Msg{}); pool != s.upstreams {
+		t.Error("query without question is forwarded to group")
+	}
+
+	// Routed query is answered by group upstream
+	request := &dns.Msg{}
+	request.SetQuestion("www.corp.test.", dns.TypeA)
+
+	w := &testResponseWriter{remoteAddr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5353}}
+	s.proxyHandler(w, request)
+	if addresses := testAddresses(w.msg); !slices.Equal(addresses, []string{"10.1.0.1"}) {
+		t.Errorf("addresses = %v, want answer of corp group", addresses)
+	}
+}
+
+func TestSetupUpstreams(t *testing.T) {
+	upstreams := []*config.ConfigUpstream{{Host: "127.0.0.1", Port: 53}}
+	groups := map[string]*config.ConfigUpstreamGroup{
+		"corp": {Strategy: StrategyParallel, Upstreams: upstreams},
+	}
+
+	tests := []struct {
+		name    string
+		groups  map[string]*config.ConfigUpstreamGroup
+		forward []*config.ConfigForward
+		err     string
+	}{
+		{
+			name:    "valid",
+			groups:  groups,
+			forward: []*config.ConfigForward{{Pattern: "+.corp.test", Group: "corp"}},
+		},
+		{
+			name:    "unknown group",
+			groups:  groups,
+			forward: []*config.ConfigForward{{Pattern: "+.corp.test", Group: "other"}},
+			err:     "unknown upstream group other",
+		},
+		{
+			name:    "invalid pattern",
+			groups:  groups,
+			forward: []*config.ConfigForward{{Pattern: "regex:/[/", Group: "corp"}},
+			err:     "forward regex:/[/",
+		},
+		{
+			name:   "empty group",
+			groups: map[string]*config.ConfigUpstreamGroup{"corp": nil},
+			err:    "upstream group corp is empty",
+		},
+		{
+			name:   "invalid group strategy",
+			groups: map[string]*config.ConfigUpstreamGroup{"corp": {Strategy: "random", Upstreams: upstreams}},
+			err:    "upstream group corp",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := &Server{config: &config.Config{
+				Strategy:       StrategySequential,
+				Upstreams:      upstreams,
+				UpstreamGroups: test.groups,
+				Forward:        test.forward,
+			}}
+
+			err := s.setupUpstreams()
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("error = %v, want %s", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(s.pools()) != 2 || s.groups["corp"].strategy != StrategyParallel {
+				t.Errorf("pools = %d, corp strategy = %s", len(s.pools()), s.groups["corp"].strategy)
+			}
+
+			request := &dns.Msg{}
+			request.SetQuestion("www.corp.test.", dns.TypeA)
+			if s.selectPool(request) != s.groups["corp"] {
+				t.Error("query is not forwarded to corp group")
+			}
+		})
+	}
+}
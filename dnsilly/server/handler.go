@@ -17,11 +17,14 @@
 package server
 
 import (
+	"dnsilly/rules"
 	"dnsilly/triggers"
 	"dnsilly/util"
 	"fmt"
 	"net"
-	"strconv"
+	"slices"
+	"strings"
+	"time"
 
 	"github.com/miekg/dns"
 )
@@ -34,88 +37,253 @@ func logHandler(w dns.ResponseWriter, r *dns.Msg) bool {
 	return true
 }
 
+// Answer records linked through CNAME chain
 type answerGroup struct {
+	// Names from owner to final CNAME target
+	chain []string
 	ipv4s []string
 	ipv6s []string
 }
 
-// Group answer results per-domain
-func makeAnswerGroups(answers []dns.RR) map[string]*answerGroup {
-	answerGroups := make(map[string]*answerGroup)
+// Domain name without trailing dot in lowercase, upstreams may randomize case
+func normalizeDomain(domain string) string {
+	return strings.ToLower(strings.TrimSuffix(domain, "."))
+}
 
-	for _, answer := range answers {
-		var ag *answerGroup
-		var ok bool
+// Group answer results per CNAME chain, addresses of final target belong to every name in chain
+func makeAnswerGroups(answers []dns.RR) []*answerGroup {
+	// Names in order of appearance
+	names := make([]string, 0)
+	targets := make(map[string]string)
+	isTarget := make(map[string]bool)
+	ipv4s := make(map[string][]string)
+	ipv6s := make(map[string][]string)
 
-		domain := answer.Header().Name
+	for _, answer := range answers {
+		domain := normalizeDomain(answer.Header().Name)
 		if len(domain) == 0 {
 			continue
 		}
 
-		if domain[len(domain)-1] == '.' {
-			domain = domain[:len(domain)-1]
+		if _, ok := ipv4s[domain]; !ok {
+			names = append(names, domain)
+			ipv4s[domain] = make([]string, 0)
+			ipv6s[domain] = make([]string, 0)
 		}
 
-		if ag, ok = answerGroups[domain]; !ok {
-			ag = &answerGroup{
-				ipv4s: make([]string, 0),
-				ipv6s: make([]string, 0),
-			}
-			answerGroups[domain] = ag
+		switch record := answer.(type) {
+		case *dns.CNAME:
+			target := normalizeDomain(record.Target)
+			targets[domain] = target
+			isTarget[target] = true
+		case *dns.A:
+			ipv4s[domain] = append(ipv4s[domain], record.A.String())
+		case *dns.AAAA:
+			ipv6s[domain] = append(ipv6s[domain], record.AAAA.String())
 		}
+	}
 
-		if headerA, ok := answer.(*dns.A); ok {
-			ag.ipv4s = append(ag.ipv4s, headerA.A.String())
+	// Chain starts at name no other record points to, usually query name
+	answerGroups := make([]*answerGroup, 0)
+	for _, domain := range names {
+		if isTarget[domain] {
+			continue
+		}
+
+		ag := &answerGroup{
+			chain: make([]string, 0),
+			ipv4s: make([]string, 0),
+			ipv6s: make([]string, 0),
 		}
 
-		if headerAAAA, ok := answer.(*dns.AAAA); ok {
-			ag.ipv6s = append(ag.ipv6s, headerAAAA.AAAA.String())
+		visited := make(map[string]bool)
+		for name := domain; name != "" && !visited[name]; name = targets[name] {
+			visited[name] = true
+			ag.chain = append(ag.chain, name)
+			ag.ipv4s = append(ag.ipv4s, ipv4s[name]...)
+			ag.ipv6s = append(ag.ipv6s, ipv6s[name]...)
 		}
+
+		answerGroups = append(answerGroups, ag)
 	}
 
 	return answerGroups
 }
 
-func (s *Server) proxyHandler(w dns.ResponseWriter, request *dns.Msg) bool {
-	// Seek for first available upstream
-	for _, upstream := range s.config.Upstreams {
-		addr := net.JoinHostPort(upstream.Host, strconv.Itoa(upstream.Port))
-
-		// TODO: Optimize JoinHostPort
-		upstreamResponse, _, err := s.client.Exchange(request, addr)
-		if err != nil {
-			fmt.Printf("[%s] Upstream %s not available: %v\n", util.Now(), addr, err)
-			continue
+// Write response, UDP responses are truncated to size client advertised in EDNS0
+// or to 512 bytes and get TC flag so client retries over TCP
+func writeResponse(w dns.ResponseWriter, request *dns.Msg, response *dns.Msg) {
+	if _, ok := w.RemoteAddr().(*net.UDPAddr); ok {
+		size := dns.MinMsgSize
+		if opt := request.IsEdns0(); opt != nil {
+			size = max(int(opt.UDPSize()), dns.MinMsgSize)
 		}
 
-		client_ip, _, err := net.SplitHostPort(w.RemoteAddr().String())
-		if err != nil {
-			client_ip = w.RemoteAddr().String()
+		response.Truncate(size)
+	}
+
+	w.WriteMsg(response)
+}
+
+// Client address without port
+func clientIP(w dns.ResponseWriter) string {
+	client_ip, _, err := net.SplitHostPort(w.RemoteAddr().String())
+	if err != nil {
+		client_ip = w.RemoteAddr().String()
+	}
+
+	return client_ip
+}
+
+// Fire triggers for matched rule and remember observation
+func (s *Server) trigger(rule *rules.Rule, qtype uint16, domain string, chain []string, ipv4 []string, ipv6 []string, client_ip string) {
+	triggers.TriggerEvent(s.config, rule, domain, chain, ipv4, ipv6, client_ip)
+
+	s.observations.Add(&observation{
+		Tag:      rule.Tag,
+		Qtype:    qtype,
+		Domain:   domain,
+		Chain:    chain,
+		Ipv4:     ipv4,
+		Ipv6:     ipv6,
+		ClientIP: client_ip,
+		Seen:     time.Now(),
+	})
+}
+
+// Fire triggers for every matched rule
+func (s *Server) triggerAll(matched []*rules.Rule, qtype uint16, domain string, chain []string, ipv4 []string, ipv6 []string, client_ip string) {
+	for _, rule := range matched {
+		s.trigger(rule, qtype, domain, chain, ipv4, ipv6, client_ip)
+	}
+}
+
+// Fire triggers for rules matching response domains
+func (s *Server) triggerResponse(client_ip string, response *dns.Msg) {
+	client := net.ParseIP(client_ip)
+
+	var qtype uint16
+	if len(response.Question) != 0 {
+		qtype = response.Question[0].Qtype
+	}
+
+	answerGroups := makeAnswerGroups(response.Answer)
+
+	// Trigger triggers for matching domains
+	for _, ag := range answerGroups {
+
+		// Check rule match, first matching name in chain wins
+		for _, domain := range ag.chain {
+			matched := s.rules.Load().Match([]byte(domain), qtype, client)
+			if len(matched) != 0 {
+				s.triggerAll(matched, qtype, domain, ag.chain, ag.ipv4s, ag.ipv6s, client_ip)
+				break
+			}
 		}
+	}
+}
 
-		answerGroups := makeAnswerGroups(upstreamResponse.Answer)
+// Sorted addresses of A and AAAA answers
+func answerAddresses(response *dns.Msg) []string {
+	addresses := make([]string, 0)
+	for _, answer := range response.Answer {
+		switch record := answer.(type) {
+		case *dns.A:
+			addresses = append(addresses, record.A.String())
+		case *dns.AAAA:
+			addresses = append(addresses, record.AAAA.String())
+		}
+	}
+	slices.Sort(addresses)
 
-		// Trigger triggers for matching domains
-		for domain, ag := range answerGroups {
+	return addresses
+}
+
+// Replace cached response with upstream one, triggers fire for client
+// that requested refresh if addresses differ from cached response
+func (s *Server) refresh(request *dns.Msg, cachedAddresses []string, client_ip string) {
+	response, err := s.selectPool(request).Exchange(request)
+	if err != nil || !isValidResponse(response) {
+		s.cache.PrefetchFailed(request)
+		return
+	}
 
-			// Check rule match
-			rule := s.rules.Match([]byte(domain))
-			if rule != nil {
-				triggers.TriggerEvent(s.config, rule, domain, ag.ipv4s, ag.ipv6s, client_ip)
+	if s.config.Verbose {
+		fmt.Printf("[%s] Prefetched %s\n", util.Now(), request.Question[0].Name)
+	}
+
+	s.cache.Set(request, response)
+
+	if !slices.Equal(answerAddresses(response), cachedAddresses) {
+		s.triggerResponse(client_ip, response)
+	}
+}
+
+// Refresh cached response in background
+func (s *Server) prefetch(request *dns.Msg, cached *dns.Msg, client_ip string) {
+	go s.refresh(request.Copy(), answerAddresses(cached), client_ip)
+}
+
+func (s *Server) proxyHandler(w dns.ResponseWriter, request *dns.Msg) bool {
+	// Reply from cache
+	if s.cache != nil {
+		if response, prefetch := s.cache.Get(request); response != nil {
+			if s.config.Verbose {
+				fmt.Printf("[%s] Cache hit\n", util.Now())
+			}
+
+			if prefetch {
+				s.prefetch(request, response, clientIP(w))
+			}
+
+			if s.config.Cache.TriggerOnHit {
+				s.triggerResponse(clientIP(w), response)
+			}
+
+			writeResponse(w, request, response)
+
+			return false
+		}
+	}
+
+	upstreamResponse, err := s.selectPool(request).Exchange(request)
+
+	// Upstream failure such as SERVFAIL is answered from cache too
+	if err != nil || !isValidResponse(upstreamResponse) {
+		// Reply with expired response
+		if s.cache != nil {
+			if response := s.cache.GetStale(request); response != nil {
+				fmt.Printf("[%s] No valid upstream response, serving stale response\n", util.Now())
+
+				if s.config.Cache.TriggerOnHit {
+					s.triggerResponse(clientIP(w), response)
+				}
+
+				writeResponse(w, request, response)
+
+				return false
 			}
 		}
+	}
 
-		// Pass response to client
-		w.WriteMsg(upstreamResponse)
+	if err != nil {
+		// No upstreams
+		fmt.Printf("[%s] No upstream available\n", util.Now())
+		response := &dns.Msg{}
+		response.SetRcode(request, dns.RcodeServerFailure)
+		writeResponse(w, request, response)
 
 		return false
 	}
 
-	// No upstreams
-	fmt.Printf("[%s] No upstream available\n", util.Now())
-	response := &dns.Msg{}
-	response.SetRcode(request, dns.RcodeServerFailure)
-	w.WriteMsg(response)
+	if s.cache != nil {
+		s.cache.Set(request, upstreamResponse)
+	}
+
+	s.triggerResponse(clientIP(w), upstreamResponse)
+
+	// Pass response to client
+	writeResponse(w, request, upstreamResponse)
 
 	return false
 }
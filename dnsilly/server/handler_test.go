@@ -0,0 +1,528 @@
+// dnsilly - dns automation utility
+// Copyright (C) 2025  bitrate16 (bitrate16@gmail.com)
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"dnsilly/config"
+	"dnsilly/rules"
+	"net"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Response writer recording written message
+type testResponseWriter struct {
+	dns.ResponseWriter
+	remoteAddr net.Addr
+	msg        *dns.Msg
+}
+
+func (w *testResponseWriter) RemoteAddr() net.Addr {
+	return w.remoteAddr
+}
+
+func (w *testResponseWriter) WriteMsg(m *dns.Msg) error {
+	w.msg = m
+	return nil
+}
+
+// Response with given count of A records
+func makeLargeResponse(request *dns.Msg, count int) *dns.Msg {
+	response := &dns.Msg{}
+	response.SetReply(request)
+
+	for i := range count {
+		response.Answer = append(response.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: request.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   net.IPv4(10, 0, byte(i/256), byte(i%256)),
+		})
+	}
+
+	return response
+}
+
+func TestWriteResponseTruncate(t *testing.T) {
+	udpAddr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5353}
+	tcpAddr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5353}
+
+	tests := []struct {
+		name      string
+		addr      net.Addr
+		edns      uint16
+		maxSize   int
+		truncated bool
+	}{
+		{name: "udp without edns", addr: udpAddr, maxSize: dns.MinMsgSize, truncated: true},
+		{name: "udp with small edns", addr: udpAddr, edns: 256, maxSize: dns.MinMsgSize, truncated: true},
+		{name: "udp with edns", addr: udpAddr, edns: 1232, maxSize: 1232, truncated: true},
+		{name: "udp with large edns", addr: udpAddr, edns: 65535, maxSize: dns.MaxMsgSize, truncated: false},
+		{name: "tcp", addr: tcpAddr, maxSize: dns.MaxMsgSize, truncated: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request := &dns.Msg{}
+			request.SetQuestion("large.test.", dns.TypeA)
+			if test.edns != 0 {
+				request.SetEdns0(test.edns, false)
+			}
+
+			w := &testResponseWriter{remoteAddr: test.addr}
+			writeResponse(w, request, makeLargeResponse(request, 200))
+
+			if w.msg.Truncated != test.truncated {
+				t.Errorf("truncated = %v, want %v", w.msg.Truncated, test.truncated)
+			}
+
+			if size := w.msg.Len(); size > test.maxSize {
+				t.Errorf("size = %d, want at most %d", size, test.maxSize)
+			}
+
+			if !test.truncated && len(w.msg.Answer) != 200 {
+				t.Errorf("answers = %d, want 200", len(w.msg.Answer))
+			}
+		})
+	}
+}
+
+// Upstream answering every request with given addresses or rcode
+type testUpstream struct {
+	name      string
+	addresses []string
+	rcode     int
+	err       error
+
+	// Delay before answer
+	delay time.Duration
+
+	// Exchanges made
+	exchanges atomic.Int32
+}
+
+func (u *testUpstream) Exchange(request *dns.Msg) (*dns.Msg, error) {
+	u.exchanges.Add(1)
+	time.Sleep(u.delay)
+
+	if u.err != nil {
+		return nil, u.err
+	}
+
+	return makeTestResponse(request, u.rcode, u.addresses...), nil
+}
+
+func (u *testUpstream) String() string {
+	if u.name != "" {
+		return u.name
+	}
+
+	return "test"
+}
+
+func (u *testUpstream) Close() {}
+
+func makeTestResponse(request *dns.Msg, rcode int, addresses ...string) *dns.Msg {
+	response := &dns.Msg{}
+	response.SetRcode(request, rcode)
+
+	for _, address := range addresses {
+		response.Answer = append(response.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: request.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   net.ParseIP(address),
+		})
+	}
+
+	return response
+}
+
+// Server with cache, single upstream and rule of "log" tag matching every domain of "test"
+func makeTestServer(t *testing.T, u upstream) *Server {
+	t.Helper()
+
+	pool, err := newUpstreamPool(StrategySequential, []upstream{u})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rule, err := rules.NewRule("log", "+.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conf := &config.Config{
+		Cache: &config.ConfigCache{
+			MaxEntries:   100,
+			ServeStale:   true,
+			Prefetch:     true,
+			PrefetchHits: 1,
+		},
+	}
+
+	s := &Server{
+		config:       conf,
+		upstreams:    pool,
+		cache:        newCache(conf.Cache),
+		observations: newObservations(0),
+	}
+	s.SetRules(rules.NewRules([]*rules.Rule{rule}))
+
+	return s
+}
+
+// Addresses of A answers
+func testAddresses(response *dns.Msg) []string {
+	addresses := make([]string, 0)
+	for _, answer := range response.Answer {
+		if record, ok := answer.(*dns.A); ok {
+			addresses = append(addresses, record.A.String())
+		}
+	}
+
+	return addresses
+}
+
+func TestProxyServeStale(t *testing.T) {
+	tests := []struct {
+		name      string
+		upstream  *testUpstream
+		stale     bool
+		rcode     int
+		addresses []string
+	}{
+		{
+			name:      "valid response",
+			upstream:  &testUpstream{addresses: []string{"10.0.0.2"}},
+			stale:     true,
+			rcode:     dns.RcodeSuccess,
+			addresses: []string{"10.0.0.2"},
+		},
+		{
+			name:      "no upstream with stale response",
+			upstream:  &testUpstream{err: errNoUpstream},
+			stale:     true,
+			rcode:     dns.RcodeSuccess,
+			addresses: []string{"10.0.0.1"},
+		},
+		{
+			name:      "servfail with stale response",
+			upstream:  &testUpstream{rcode: dns.RcodeServerFailure},
+			stale:     true,
+			rcode:     dns.RcodeSuccess,
+			addresses: []string{"10.0.0.1"},
+		},
+		{
+			name:      "refused with stale response",
+			upstream:  &testUpstream{rcode: dns.RcodeRefused},
+			stale:     true,
+			rcode:     dns.RcodeSuccess,
+			addresses: []string{"10.0.0.1"},
+		},
+		{
+			name:      "servfail without stale response",
+			upstream:  &testUpstream{rcode: dns.RcodeServerFailure},
+			rcode:     dns.RcodeServerFailure,
+			addresses: []string{},
+		},
+		{
+			name:      "no upstream without stale response",
+			upstream:  &testUpstream{err: errNoUpstream},
+			rcode:     dns.RcodeServerFailure,
+			addresses: []string{},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := makeTestServer(t, test.upstream)
+
+			request := &dns.Msg{}
+			request.SetQuestion("stale.test.", dns.TypeA)
+
+			// Expired entry
+			if test.stale {
+				now := time.Now()
+				s.cache.Restore([]*cacheEntry{{
+					key:      makeCacheKey(request.Question[0]),
+					response: makeTestResponse(request, dns.RcodeSuccess, "10.0.0.1"),
+					stored:   now.Add(-2 * time.Minute),
+					expires:  now.Add(-time.Minute),
+				}})
+			}
+
+			w := &testResponseWriter{remoteAddr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5353}}
+			s.proxyHandler(w, request)
+
+			if w.msg.Rcode != test.rcode {
+				t.Errorf("rcode = %s, want %s", dns.RcodeToString[w.msg.Rcode], dns.RcodeToString[test.rcode])
+			}
+			if addresses := testAddresses(w.msg); !slices.Equal(addresses, test.addresses) {
+				t.Errorf("addresses = %v, want %v", addresses, test.addresses)
+			}
+		})
+	}
+}
+
+func TestPrefetchTriggers(t *testing.T) {
+	tests := []struct {
+		name      string
+		cached    []string
+		upstream  *testUpstream
+		triggered bool
+		refreshed []string
+	}{
+		{
+			name:      "same addresses",
+			cached:    []string{"10.0.0.1", "10.0.0.2"},
+			upstream:  &testUpstream{addresses: []string{"10.0.0.2", "10.0.0.1"}},
+			triggered: false,
+			refreshed: []string{"10.0.0.2", "10.0.0.1"},
+		},
+		{
+			name:      "changed address",
+			cached:    []string{"10.0.0.1"},
+			upstream:  &testUpstream{addresses: []string{"10.0.0.3"}},
+			triggered: true,
+			refreshed: []string{"10.0.0.3"},
+		},
+		{
+			name:      "added address",
+			cached:    []string{"10.0.0.1"},
+			upstream:  &testUpstream{addresses: []string{"10.0.0.1", "10.0.0.3"}},
+			triggered: true,
+			refreshed: []string{"10.0.0.1", "10.0.0.3"},
+		},
+		{
+			name:      "servfail",
+			cached:    []string{"10.0.0.1"},
+			upstream:  &testUpstream{rcode: dns.RcodeServerFailure},
+			triggered: false,
+			refreshed: []string{"10.0.0.1"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := makeTestServer(t, test.upstream)
+
+			request := &dns.Msg{}
+			request.SetQuestion("prefetch.test.", dns.TypeA)
+
+			cached := makeTestResponse(request, dns.RcodeSuccess, test.cached...)
+			s.cache.Set(request, cached)
+
+			s.refresh(request, answerAddresses(cached), "10.1.1.1")
+
+			observations := s.observations.List()
+			if triggered := len(observations) != 0; triggered != test.triggered {
+				t.Fatalf("triggered = %v, want %v", triggered, test.triggered)
+			}
+			if test.triggered {
+				obs := observations[0]
+				if obs.Tag != "log" || obs.Domain != "prefetch.test" || obs.ClientIP != "10.1.1.1" || !slices.Equal(obs.Ipv4, test.upstream.addresses) {
+					t.Errorf("unexpected observation %+v", obs)
+				}
+			}
+
+			response, _ := s.cache.Get(request)
+			if response == nil {
+				t.Fatal("response is not cached")
+			}
+			if addresses := testAddresses(response); !slices.Equal(addresses, test.refreshed) {
+				t.Errorf("cached addresses = %v, want %v", addresses, test.refreshed)
+			}
+		})
+	}
+}
+
+// Records parsed from zone file lines
+func testRecords(t *testing.T, lines ...string) []dns.RR {
+	t.Helper()
+
+	records := make([]dns.RR, 0, len(lines))
+	for _, line := range lines {
+		record, err := dns.NewRR(line)
+		if err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, record)
+	}
+
+	return records
+}
+
+func TestMakeAnswerGroups(t *testing.T) {
+	tests := []struct {
+		name    string
+		answers []string
+		want    []answerGroup
+	}{
+		{
+			name:    "address",
+			answers: []string{"a.test. 60 IN A 10.0.0.1", "a.test. 60 IN A 10.0.0.2"},
+			want:    []answerGroup{{chain: []string{"a.test"}, ipv4s: []string{"10.0.0.1", "10.0.0.2"}, ipv6s: []string{}}},
+		},
+		{
+			name: "multi-hop chain",
+			answers: []string{
+				"www.a.test. 60 IN CNAME edge.cdn.test.",
+				"edge.cdn.test. 60 IN CNAME node.cdn.test.",
+				"node.cdn.test. 60 IN A 10.0.0.1",
+				"node.cdn.test. 60 IN AAAA fd00::1",
+			},
+			want: []answerGroup{{
+				chain: []string{"www.a.test", "edge.cdn.test", "node.cdn.test"},
+				ipv4s: []string{"10.0.0.1"},
+				ipv6s: []string{"fd00::1"},
+			}},
+		},
+		{
+			name: "chain out of order",
+			answers: []string{
+				"node.cdn.test. 60 IN A 10.0.0.1",
+				"edge.cdn.test. 60 IN CNAME node.cdn.test.",
+				"www.a.test. 60 IN CNAME edge.cdn.test.",
+			},
+			want: []answerGroup{{
+				chain: []string{"www.a.test", "edge.cdn.test", "node.cdn.test"},
+				ipv4s: []string{"10.0.0.1"},
+				ipv6s: []string{},
+			}},
+		},
+		{
+			name: "mixed case owners",
+			answers: []string{
+				"WwW.A.tEsT. 60 IN CNAME Edge.CDN.test.",
+				"eDGE.cdn.TEST. 60 IN A 10.0.0.1",
+			},
+			want: []answerGroup{{
+				chain: []string{"www.a.test", "edge.cdn.test"},
+				ipv4s: []string{"10.0.0.1"},
+				ipv6s: []string{},
+			}},
+		},
+		{
+			name: "loop after query name",
+			answers: []string{
+				"www.a.test. 60 IN CNAME x.test.",
+				"x.test. 60 IN CNAME y.test.",
+				"y.test. 60 IN CNAME x.test.",
+			},
+			want: []answerGroup{{
+				chain: []string{"www.a.test", "x.test", "y.test"},
+				ipv4s: []string{},
+				ipv6s: []string{},
+			}},
+		},
+		{
+			name: "loop without entry",
+			answers: []string{
+				"x.test. 60 IN CNAME y.test.",
+				"y.test. 60 IN CNAME x.test.",
+			},
+			want: []answerGroup{},
+		},
+		{
+			name: "separate owners",
+			answers: []string{
+				"a.test. 60 IN A 10.0.0.1",
+				"b.test. 60 IN CNAME c.test.",
+				"c.test. 60 IN A 10.0.0.2",
+			},
+			want: []answerGroup{
+				{chain: []string{"a.test"}, ipv4s: []string{"10.0.0.1"}, ipv6s: []string{}},
+				{chain: []string{"b.test", "c.test"}, ipv4s: []string{"10.0.0.2"}, ipv6s: []string{}},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			groups := makeAnswerGroups(testRecords(t, test.answers...))
+
+			if len(groups) != len(test.want) {
+				t.Fatalf("groups = %d, want %d", len(groups), len(test.want))
+			}
+			for i, group := range groups {
+				want := test.want[i]
+				if !slices.Equal(group.chain, want.chain) || !slices.Equal(group.ipv4s, want.ipv4s) || !slices.Equal(group.ipv6s, want.ipv6s) {
+					t.Errorf("group %d = %+v, want %+v", i, *group, want)
+				}
+			}
+		})
+	}
+}
+
+func TestTriggerResponseChain(t *testing.T) {
+	tests := []struct {
+		name    string
+		pattern string
+		domain  string
+	}{
+		{name: "query name", pattern: "www.a.test", domain: "www.a.test"},
+		{name: "alias in the middle", pattern: "+.cdn.test", domain: "edge.cdn.test"},
+		{name: "final target", pattern: "node.cdn.test", domain: "node.cdn.test"},
+		{name: "no match", pattern: "other.test"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := makeTestServer(t, &testUpstream{})
+
+			rule, err := rules.NewRule("log", test.pattern)
+			if err != nil {
+				t.Fatal(err)
+			}
+			s.SetRules(rules.NewRules([]*rules.Rule{rule}))
+
+			request := &dns.Msg{}
+			request.SetQuestion("www.a.test.", dns.TypeA)
+
+			response := &dns.Msg{}
+			response.SetReply(request)
+			response.Answer = testRecords(t,
+				"www.a.test. 60 IN CNAME edge.cdn.test.",
+				"edge.cdn.test. 60 IN CNAME node.cdn.test.",
+				"node.cdn.test. 60 IN A 10.0.0.1",
+			)
+
+			s.triggerResponse("10.1.1.1", response)
+
+			observations := s.observations.List()
+			if test.domain == "" {
+				if len(observations) != 0 {
+					t.Fatalf("unexpected observations %v", observedDomains(observations))
+				}
+				return
+			}
+
+			// First matching name of chain fires once with addresses of final target
+			if len(observations) != 1 {
+				t.Fatalf("observations = %v, want single", observedDomains(observations))
+			}
+			obs := observations[0]
+			if obs.Domain != test.domain || obs.Qtype != dns.TypeA || obs.ClientIP != "10.1.1.1" {
+				t.Errorf("unexpected observation %+v", obs)
+			}
+			if !slices.Equal(obs.Chain, []string{"www.a.test", "edge.cdn.test", "node.cdn.test"}) || !slices.Equal(obs.Ipv4, []string{"10.0.0.1"}) {
+				t.Errorf("chain = %v, ipv4 = %v", obs.Chain, obs.Ipv4)
+			}
+		})
+	}
+}
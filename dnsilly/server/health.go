@@ -0,0 +1,89 @@
+// dnsilly - dns automation utility
+// Copyright (C) 2025  bitrate16 (bitrate16@gmail.com)
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"dnsilly/config"
+	"dnsilly/triggers"
+	"dnsilly/util"
+	"fmt"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Default health check probe interval
+const defaultHealthCheckInterval = 10 * time.Second
+
+// Probe upstreams periodically until stop is closed, marking failing ones down
+func (s *Server) runHealthCheck(conf *config.ConfigHealthCheck, stop chan struct{}) {
+	interval := conf.Interval
+	if interval == 0 {
+		interval = defaultHealthCheckInterval
+	}
+
+	qtype, ok := dns.StringToType[conf.Type]
+	if !ok {
+		fmt.Printf("[%s] Health check disabled, unknown query type: %s\n", util.Now(), conf.Type)
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			for _, pool := range s.pools() {
+				for _, u := range pool.upstreams {
+					go s.probeUpstream(conf, u, qtype)
+				}
+			}
+		}
+	}
+}
+
+func (s *Server) probeUpstream(conf *config.ConfigHealthCheck, u *pooledUpstream, qtype uint16) {
+	probe := &dns.Msg{}
+	probe.SetQuestion(dns.Fqdn(conf.Query), qtype)
+
+	response, err := u.exchange(probe)
+	if err == nil && !isValidResponse(response) {
+		err = fmt.Errorf("rcode %s", dns.RcodeToString[response.Rcode])
+	}
+
+	if err == nil {
+		u.failures.Store(0)
+		if u.down.CompareAndSwap(true, false) {
+			fmt.Printf("[%s] Upstream %s is up\n", util.Now(), u)
+			triggers.TriggerUpstream(s.config, triggers.OnUpstreamUp, u.String())
+		}
+
+		return
+	}
+
+	if s.config.Verbose {
+		fmt.Printf("[%s] Upstream %s health check failed: %v\n", util.Now(), u, err)
+	}
+
+	if int(u.failures.Add(1)) >= conf.Failures && u.down.CompareAndSwap(false, true) {
+		fmt.Printf("[%s] Upstream %s is down\n", util.Now(), u)
+		triggers.TriggerUpstream(s.config, triggers.OnUpstreamDown, u.String())
+	}
+}
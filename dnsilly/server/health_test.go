@@ -0,0 +1,188 @@
+// dnsilly - dns automation utility
+// Copyright (C) 2025  bitrate16 (bitrate16@gmail.com)
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"dnsilly/config"
+	"dnsilly/triggers"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Lifecycle endpoint recording upstream state changes
+type testLifecycleServer struct {
+	lock   sync.Mutex
+	states []string
+}
+
+func (s *testLifecycleServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	payload := triggers.TriggerLifecyclePayload{}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.states = append(s.states, payload.State+" "+payload.Upstream)
+}
+
+func (s *testLifecycleServer) list() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return slices.Clone(s.states)
+}
+
+// Upstream failing while flag is set, safe to switch during probes
+type testFlakyUpstream struct {
+	testUpstream
+	failing atomic.Bool
+}
+
+func (u *testFlakyUpstream) Exchange(request *dns.Msg) (*dns.Msg, error) {
+	if u.failing.Load() {
+		return nil, errTestUpstream
+	}
+
+	return u.testUpstream.Exchange(request)
+}
+
+// Server with single pool and lifecycle endpoint
+func makeHealthTestServer(t *testing.T, upstreams ...upstream) (*Server, *testLifecycleServer) {
+	t.Helper()
+
+	lifecycle := &testLifecycleServer{}
+	endpoint := httptest.NewServer(lifecycle)
+	t.Cleanup(endpoint.Close)
+
+	pool, err := newUpstreamPool(StrategySequential, upstreams)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &Server{
+		config: &config.Config{
+			Trigger: &config.ConfigTrigger{
+				JSONHTTP: []*config.ConfigTriggerJSONHTTP{{LifecycleEndpoint: endpoint.URL}},
+			},
+		},
+		upstreams: pool,
+	}
+
+	return s, lifecycle
+}
+
+func TestProbeUpstream(t *testing.T) {
+	u := &testUpstream{name: "primary", addresses: []string{"10.0.0.1"}}
+	s, lifecycle := makeHealthTestServer(t, u)
+	pooled := s.upstreams.upstreams[0]
+
+	conf := &config.ConfigHealthCheck{Query: ".", Type: "NS", Failures: 2}
+
+	steps := []struct {
+		name     string
+		err      error
+		rcode    int
+		failures int32
+		down     bool
+		states   []string
+	}{
+		{name: "healthy", failures: 0},
+		{name: "first failure", err: errTestUpstream, failures: 1},
+		{name: "recovered before ejection", failures: 0},
+		{name: "servfail", rcode: dns.RcodeServerFailure, failures: 1},
+		{name: "ejected", err: errTestUpstream, failures: 2, down: true, states: []string{"upstream_down primary"}},
+		{name: "still down", err: errTestUpstream, failures: 3, down: true, states: []string{"upstream_down primary"}},
+		{name: "refused", rcode: dns.RcodeRefused, failures: 4, down: true, states: []string{"upstream_down primary"}},
+		{name: "recovered", failures: 0, states: []string{"upstream_down primary", "upstream_up primary"}},
+		{name: "still up", failures: 0, states: []string{"upstream_down primary", "upstream_up primary"}},
+	}
+
+	for _, step := range steps {
+		u.err, u.rcode = step.err, step.rcode
+		s.probeUpstream(conf, pooled, dns.TypeNS)
+
+		if pooled.failures.Load() != step.failures || pooled.down.Load() != step.down {
+			t.Errorf("%s: failures = %d, down = %v, want %d, %v", step.name, pooled.failures.Load(), pooled.down.Load(), step.failures, step.down)
+		}
+		if states := lifecycle.list(); !slices.Equal(states, step.states) {
+			t.Errorf("%s: triggered %v, want %v", step.name, states, step.states)
+		}
+	}
+}
+
+func TestHealthCheckEjection(t *testing.T) {
+	primary := &testFlakyUpstream{testUpstream: testUpstream{name: "primary"}}
+	primary.failing.Store(true)
+	secondary := &testUpstream{name: "secondary", addresses: []string{"10.0.0.2"}}
+	s, lifecycle := makeHealthTestServer(t, primary, secondary)
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		s.runHealthCheck(&config.ConfigHealthCheck{Interval: 5 * time.Millisecond, Query: ".", Type: "NS", Failures: 2}, stop)
+		close(done)
+	}()
+	defer func() {
+		close(stop)
+		<-done
+	}()
+
+	waitState := func(want []string) {
+		t.Helper()
+
+		deadline := time.Now().Add(5 * time.Second)
+		for !slices.Equal(lifecycle.list(), want) {
+			if time.Now().After(deadline) {
+				t.Fatalf("triggered %v, want %v", lifecycle.list(), want)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+
+	waitState([]string{"upstream_down primary"})
+
+	// Queries skip ejected upstream
+	request := &dns.Msg{}
+	request.SetQuestion("health.test.", dns.TypeA)
+	for _, u := range s.upstreams.ordered() {
+		if u.String() == "primary" {
+			t.Error("ejected upstream is ordered for queries")
+		}
+	}
+	response, err := s.upstreams.Exchange(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addresses := testAddresses(response); !slices.Equal(addresses, []string{"10.0.0.2"}) {
+		t.Errorf("addresses = %v", addresses)
+	}
+
+	// Probes continue and bring upstream back
+	primary.failing.Store(false)
+	waitState([]string{"upstream_down primary", "upstream_up primary"})
+}
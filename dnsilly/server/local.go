@@ -0,0 +1,167 @@
+// dnsilly - dns automation utility
+// Copyright (C) 2025  bitrate16 (bitrate16@gmail.com)
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"dnsilly/rules"
+	"dnsilly/util"
+	"fmt"
+	"net"
+	"slices"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Default TTL of answers from local rules
+const defaultLocalTTL = 60 * time.Second
+
+func (s *Server) localTTL() uint32 {
+	if s.config.LocalTTL == 0 {
+		return uint32(defaultLocalTTL.Seconds())
+	}
+
+	return uint32(s.config.LocalTTL.Seconds())
+}
+
+// Answer A and AAAA queries from address rule
+func (s *Server) answerAddress(response *dns.Msg, question dns.Question, rule *rules.Rule) ([]string, []string) {
+	ipv4 := make([]string, 0)
+	ipv6 := make([]string, 0)
+
+	header := dns.RR_Header{
+		Name:   question.Name,
+		Rrtype: question.Qtype,
+		Class:  question.Qclass,
+		Ttl:    s.localTTL(),
+	}
+
+	for _, ip := range rule.Addresses {
+		if ip4 := ip.To4(); ip4 != nil {
+			if question.Qtype == dns.TypeA {
+				response.Answer = append(response.Answer, &dns.A{Hdr: header, A: ip4})
+				ipv4 = append(ipv4, ip4.String())
+			}
+		} else if question.Qtype == dns.TypeAAAA {
+			response.Answer = append(response.Answer, &dns.AAAA{Hdr: header, AAAA: ip})
+			ipv6 = append(ipv6, ip.String())
+		}
+	}
+
+	return ipv4, ipv6
+}
+
+// Answer with CNAME from rule, A and AAAA queries for target are resolved upstream
+func (s *Server) answerCNAME(response *dns.Msg, question dns.Question, rule *rules.Rule) ([]string, []string) {
+	target := dns.Fqdn(rule.Target)
+	response.Answer = append(response.Answer, &dns.CNAME{
+		Hdr: dns.RR_Header{
+			Name:   question.Name,
+			Rrtype: dns.TypeCNAME,
+			Class:  question.Qclass,
+			Ttl:    s.localTTL(),
+		},
+		Target: target,
+	})
+
+	ipv4 := make([]string, 0)
+	ipv6 := make([]string, 0)
+	if question.Qtype == dns.TypeCNAME {
+		return ipv4, ipv6
+	}
+
+	// Resolve target
+	request := &dns.Msg{}
+	request.SetQuestion(target, question.Qtype)
+	request.RecursionDesired = true
+
+	targetResponse, err := s.selectPool(request).Exchange(request)
+	if err != nil {
+		fmt.Printf("[%s] No upstream available for cname target %s\n", util.Now(), rule.Target)
+		response.Rcode = dns.RcodeServerFailure
+		return ipv4, ipv6
+	}
+
+	response.Rcode = targetResponse.Rcode
+	response.Answer = append(response.Answer, targetResponse.Answer...)
+
+	answerGroups := makeAnswerGroups(response.Answer)
+	if len(answerGroups) == 0 {
+		return ipv4, ipv6
+	}
+
+	return answerGroups[0].ipv4s, answerGroups[0].ipv6s
+}
+
+// CNAME chain of first answer group
+func answerChain(response *dns.Msg) []string {
+	answerGroups := makeAnswerGroups(response.Answer)
+	if len(answerGroups) == 0 {
+		return []string{}
+	}
+
+	return answerGroups[0].chain
+}
+
+// Answer A, AAAA and CNAME queries matching address and cname rules locally
+func (s *Server) localHandler(w dns.ResponseWriter, request *dns.Msg) bool {
+	if len(request.Question) != 1 {
+		return true
+	}
+
+	question := request.Question[0]
+	if question.Qtype != dns.TypeA && question.Qtype != dns.TypeAAAA && question.Qtype != dns.TypeCNAME {
+		return true
+	}
+
+	domain := normalizeDomain(question.Name)
+
+	client_ip := clientIP(w)
+
+	matched := s.rules.Load().Match([]byte(domain), question.Qtype, net.ParseIP(client_ip))
+
+	// First matched rule with local data
+	i := slices.IndexFunc(matched, (*rules.Rule).IsLocal)
+	if i == -1 {
+		return true
+	}
+	rule := matched[i]
+
+	if s.config.Verbose {
+		fmt.Printf("[%s] Local %s %s\n", util.Now(), rule.Tag, domain)
+	}
+
+	response := &dns.Msg{}
+	response.SetReply(request)
+	response.RecursionAvailable = true
+	response.Authoritative = true
+
+	var ipv4, ipv6 []string
+	chain := []string{domain}
+	if rule.Tag == rules.TagAddress {
+		ipv4, ipv6 = s.answerAddress(response, question, rule)
+	} else {
+		ipv4, ipv6 = s.answerCNAME(response, question, rule)
+		chain = answerChain(response)
+	}
+
+	s.triggerAll(matched, question.Qtype, domain, chain, ipv4, ipv6, client_ip)
+
+	writeResponse(w, request, response)
+
+	return false
+}
@@ -0,0 +1,221 @@
+// dnsilly - dns automation utility
+// Copyright (C) 2025  bitrate16 (bitrate16@gmail.com)
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"dnsilly/rules"
+	"net"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Answers as "<type> <data>" without owner and TTL
+func answerStrings(response *dns.Msg) []string {
+	answers := make([]string, 0, len(response.Answer))
+	for _, answer := range response.Answer {
+		switch record := answer.(type) {
+		case *dns.A:
+			answers = append(answers, "A "+record.A.String())
+		case *dns.AAAA:
+			answers = append(answers, "AAAA "+record.AAAA.String())
+		case *dns.CNAME:
+			answers = append(answers, "CNAME "+record.Target)
+		default:
+			answers = append(answers, answer.String())
+		}
+	}
+
+	return answers
+}
+
+// Server with address and cname rules before "log" rule of every domain of "test"
+func makeLocalTestServer(t *testing.T, u upstream) *Server {
+	t.Helper()
+
+	s := makeTestServer(t, u)
+
+	address, err := rules.NewRule(rules.TagAddress, "printer.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address.Addresses = []net.IP{net.ParseIP("10.0.0.5"), net.ParseIP("fd00::5")}
+	address.Continue = true
+
+	ipv4Only, err := rules.NewRule(rules.TagAddress, "+.nas.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ipv4Only.Addresses = []net.IP{net.ParseIP("10.0.0.6")}
+
+	cname, err := rules.NewRule(rules.TagCNAME, "www.alias.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cname.Target = "target.test"
+
+	log, err := rules.NewRule("log", "+.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.SetRules(rules.NewRules([]*rules.Rule{address, ipv4Only, cname, log}))
+
+	return s
+}
+
+func TestLocalHandler(t *testing.T) {
+	tests := []struct {
+		name     string
+		qname    string
+		qtype    uint16
+		upstream *testUpstream
+		localTTL time.Duration
+
+		// Query is passed to next handler
+		passed  bool
+		rcode   int
+		answers []string
+
+		// Observations as "<tag> <chain>"
+		observed []string
+	}{
+		{
+			name:     "address A",
+			qname:    "Printer.test.",
+			qtype:    dns.TypeA,
+			answers:  []string{"A 10.0.0.5"},
+			observed: []string{"address printer.test", "log printer.test"},
+		},
+		{
+			name:     "address AAAA",
+			qname:    "printer.test.",
+			qtype:    dns.TypeAAAA,
+			localTTL: 5 * time.Minute,
+			answers:  []string{"AAAA fd00::5"},
+			observed: []string{"address printer.test", "log printer.test"},
+		},
+		{
+			name:     "address without AAAA",
+			qname:    "backup.nas.test.",
+			qtype:    dns.TypeAAAA,
+			answers:  []string{},
+			observed: []string{"address backup.nas.test"},
+		},
+		{
+			name:   "address other type",
+			qname:  "printer.test.",
+			qtype:  dns.TypeMX,
+			passed: true,
+		},
+		{
+			name:     "cname query",
+			qname:    "www.alias.test.",
+			qtype:    dns.TypeCNAME,
+			answers:  []string{"CNAME target.test."},
+			observed: []string{"cname www.alias.test,target.test"},
+		},
+		{
+			name:     "cname resolved upstream",
+			qname:    "www.alias.test.",
+			qtype:    dns.TypeA,
+			upstream: &testUpstream{addresses: []string{"10.0.0.1"}},
+			answers:  []string{"CNAME target.test.", "A 10.0.0.1"},
+			observed: []string{"cname www.alias.test,target.test"},
+		},
+		{
+			name:     "cname target nxdomain",
+			qname:    "www.alias.test.",
+			qtype:    dns.TypeA,
+			upstream: &testUpstream{rcode: dns.RcodeNameError},
+			rcode:    dns.RcodeNameError,
+			answers:  []string{"CNAME target.test."},
+			observed: []string{"cname www.alias.test,target.test"},
+		},
+		{
+			name:     "cname target unavailable",
+			qname:    "www.alias.test.",
+			qtype:    dns.TypeA,
+			upstream: &testUpstream{err: errNoUpstream},
+			rcode:    dns.RcodeServerFailure,
+			answers:  []string{"CNAME target.test."},
+			observed: []string{"cname www.alias.test,target.test"},
+		},
+		{
+			name:   "no local rule",
+			qname:  "other.test.",
+			qtype:  dns.TypeA,
+			passed: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			u := test.upstream
+			if u == nil {
+				u = &testUpstream{}
+			}
+
+			s := makeLocalTestServer(t, u)
+			s.config.LocalTTL = test.localTTL
+
+			request := &dns.Msg{}
+			request.SetQuestion(test.qname, test.qtype)
+
+			w := &testResponseWriter{remoteAddr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5353}}
+			if passed := s.localHandler(w, request); passed != test.passed {
+				t.Fatalf("passed = %v, want %v", passed, test.passed)
+			}
+			if test.passed {
+				if w.msg != nil || len(s.observations.List()) != 0 {
+					t.Error("passed query answered locally")
+				}
+				return
+			}
+
+			response := w.msg
+			if response.Rcode != test.rcode || !response.Authoritative || response.Id != request.Id {
+				t.Errorf("rcode = %s, authoritative = %v", dns.RcodeToString[response.Rcode], response.Authoritative)
+			}
+			if answers := answerStrings(response); !slices.Equal(answers, test.answers) {
+				t.Errorf("answers = %v, want %v", answers, test.answers)
+			}
+
+			// Local records are answered with owner of query and local TTL
+			ttl := uint32(defaultLocalTTL.Seconds())
+			if test.localTTL != 0 {
+				ttl = uint32(test.localTTL.Seconds())
+			}
+			if len(response.Answer) != 0 {
+				if header := response.Answer[0].Header(); header.Name != test.qname || header.Ttl != ttl {
+					t.Errorf("first answer = %s, want owner %s and ttl %d", response.Answer[0], test.qname, ttl)
+				}
+			}
+
+			observed := make([]string, 0)
+			for _, obs := range s.observations.List() {
+				observed = append(observed, obs.Tag+" "+strings.Join(obs.Chain, ","))
+			}
+			if !slices.Equal(observed, test.observed) {
+				t.Errorf("observed = %v, want %v", observed, test.observed)
+			}
+		})
+	}
+}
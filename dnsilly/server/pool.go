@@ -0,0 +1,232 @@
+// dnsilly - dns automation utility
+// Copyright (C) 2025  bitrate16 (bitrate16@gmail.com)
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"dnsilly/config"
+	"dnsilly/util"
+	"errors"
+	"fmt"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Upstream selection strategies
+const (
+	// Try upstreams in order until one answers
+	StrategySequential = "sequential"
+	// Query all upstreams at once and take first valid answer
+	StrategyParallel = "parallel"
+	// Rotate first upstream between queries
+	StrategyRoundRobin = "round_robin"
+	// Try upstreams in order of measured latency
+	StrategyFastest = "fastest"
+)
+
+// Latency recorded for failed exchange
+const upstreamFailurePenalty = 5 * time.Second
+
+var errNoUpstream = errors.New("no upstream available")
+
+// Upstream with measured latency
+type pooledUpstream struct {
+	upstream
+
+	// Moving average of exchange duration in nanoseconds
+	latency atomic.Int64
+
+	// Health check state
+	failures atomic.Int32
+	down     atomic.Bool
+}
+
+func (u *pooledUpstream) exchange(request *dns.Msg) (*dns.Msg, error) {
+	start := time.Now()
+	response, err := u.Exchange(request)
+
+	elapsed := time.Since(start)
+	if err != nil {
+		elapsed = upstreamFailurePenalty
+	}
+
+	// Exponential moving average, first sample taken as is
+	previous := u.latency.Load()
+	if previous == 0 {
+		u.latency.Store(int64(elapsed))
+	} else {
+		u.latency.Store((previous*7 + int64(elapsed)) / 8)
+	}
+
+	return response, err
+}
+
+// Set of upstreams queried with selected strategy
+type upstreamPool struct {
+	strategy  string
+	upstreams []*pooledUpstream
+
+	// Round robin position
+	next atomic.Uint32
+}
+
+func newUpstreamPool(strategy string, upstreams []upstream) (*upstreamPool, error) {
+	switch strategy {
+	case "":
+		strategy = StrategySequential
+	case StrategySequential, StrategyParallel, StrategyRoundRobin, StrategyFastest:
+	default:
+		return nil, fmt.Errorf("unsupported upstream strategy: %s", strategy)
+	}
+
+	pool := &upstreamPool{
+		strategy:  strategy,
+		upstreams: make([]*pooledUpstream, 0, len(upstreams)),
+	}
+	for _, u := range upstreams {
+		pool.upstreams = append(pool.upstreams, &pooledUpstream{
+			upstream: u,
+		})
+	}
+
+	return pool, nil
+}
+
+// Make pool from upstreams config
+func makeUpstreamPool(strategy string, confs []*config.ConfigUpstream, verbose bool) (*upstreamPool, error) {
+	upstreams := make([]upstream, 0, len(confs))
+	for _, conf := range confs {
+		u, err := newUpstream(conf, verbose)
+		if err != nil {
+			return nil, err
+		}
+		upstreams = append(upstreams, u)
+	}
+
+	return newUpstreamPool(strategy, upstreams)
+}
+
+func (p *upstreamPool) Close() {
+	for _, u := range p.upstreams {
+		u.Close()
+	}
+}
+
+// Upstreams in order they should be tried
+func (p *upstreamPool) ordered() []*pooledUpstream {
+	// Skip upstreams marked down
+	upstreams := make([]*pooledUpstream, 0, len(p.upstreams))
+	for _, u := range p.upstreams {
+		if !u.down.Load() {
+			upstreams = append(upstreams, u)
+		}
+	}
+
+	// Try all when everything is down
+	if len(upstreams) == 0 {
+		upstreams = append(upstreams, p.upstreams...)
+	}
+
+	switch p.strategy {
+	case StrategyRoundRobin:
+		if len(upstreams) != 0 {
+			offset := int(p.next.Add(1)-1) % len(upstreams)
+			upstreams = append(upstreams[offset:], upstreams[:offset]...)
+		}
+	case StrategyFastest:
+		sort.SliceStable(upstreams, func(i, j int) bool {
+			return upstreams[i].latency.Load() < upstreams[j].latency.Load()
+		})
+	}
+
+	return upstreams
+}
+
+func (p *upstreamPool) Exchange(request *dns.Msg) (*dns.Msg, error) {
+	upstreams := p.ordered()
+
+	if p.strategy == StrategyParallel {
+		return p.exchangeParallel(request, upstreams)
+	}
+
+	// Seek for first available upstream
+	for _, u := range upstreams {
+		response, err := u.exchange(request)
+		if err != nil {
+			fmt.Printf("[%s] Upstream %s not available: %v\n", util.Now(), u, err)
+			continue
+		}
+
+		return response, nil
+	}
+
+	return nil, errNoUpstream
+}
+
+// Response can be taken without waiting for other upstreams
+func isValidResponse(response *dns.Msg) bool {
+	return response.Rcode != dns.RcodeServerFailure && response.Rcode != dns.RcodeRefused
+}
+
+func (p *upstreamPool) exchangeParallel(request *dns.Msg, upstreams []*pooledUpstream) (*dns.Msg, error) {
+	if len(upstreams) == 0 {
+		return nil, errNoUpstream
+	}
+
+	type result struct {
+		response *dns.Msg
+		err      error
+	}
+
+	// Buffered to let late upstreams finish without receiver
+	results := make(chan result, len(upstreams))
+	for _, u := range upstreams {
+		go func() {
+			// Messages are not safe for concurrent use
+			response, err := u.exchange(request.Copy())
+			if err != nil {
+				fmt.Printf("[%s] Upstream %s not available: %v\n", util.Now(), u, err)
+			}
+			results <- result{response, err}
+		}()
+	}
+
+	// Fallback to invalid answer if no valid one received
+	var fallback *dns.Msg
+	for range upstreams {
+		r := <-results
+		if r.err != nil {
+			continue
+		}
+
+		if isValidResponse(r.response) {
+			return r.response, nil
+		}
+
+		if fallback == nil {
+			fallback = r.response
+		}
+	}
+
+	if fallback != nil {
+		return fallback, nil
+	}
+
+	return nil, errNoUpstream
+}
@@ -0,0 +1,291 @@
+// dnsilly - dns automation utility
+// Copyright (C) 2025  bitrate16 (bitrate16@gmail.com)
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+var errTestUpstream = errors.New("upstream failure")
+
+func makeTestPool(t *testing.T, strategy string, upstreams ...*testUpstream) *upstreamPool {
+	t.Helper()
+
+	list := make([]upstream, 0, len(upstreams))
+	for _, u := range upstreams {
+		list = append(list, u)
+	}
+
+	pool, err := newUpstreamPool(strategy, list)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return pool
+}
+
+// Exchange test query through pool
+func testExchange(pool *upstreamPool) (*dns.Msg, error) {
+	request := &dns.Msg{}
+	request.SetQuestion("pool.test.", dns.TypeA)
+
+	return pool.Exchange(request)
+}
+
+func TestPoolStrategy(t *testing.T) {
+	if _, err := newUpstreamPool("random", nil); err == nil {
+		t.Error("unknown strategy accepted")
+	}
+
+	pool, err := newUpstreamPool("", nil)
+	if err != nil || pool.strategy != StrategySequential {
+		t.Errorf("default strategy = %v, %v", pool, err)
+	}
+
+	if _, err := testExchange(pool); !errors.Is(err, errNoUpstream) {
+		t.Errorf("empty pool error = %v", err)
+	}
+}
+
+func TestPoolSequential(t *testing.T) {
+	failing := &testUpstream{err: errTestUpstream}
+	servfail := &testUpstream{rcode: dns.RcodeServerFailure}
+	valid := &testUpstream{addresses: []string{"10.0.0.2"}}
+
+	// Upstream error moves to next upstream, any response is taken
+	response, err := testExchange(makeTestPool(t, StrategySequential, failing, servfail, valid))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.Rcode != dns.RcodeServerFailure || valid.exchanges.Load() != 0 {
+		t.Errorf("rcode = %s, valid exchanges = %d", dns.RcodeToString[response.Rcode], valid.exchanges.Load())
+	}
+
+	if _, err := testExchange(makeTestPool(t, StrategySequential, failing)); !errors.Is(err, errNoUpstream) {
+		t.Errorf("error = %v, want %v", err, errNoUpstream)
+	}
+}
+
+func TestPoolParallel(t *testing.T) {
+	tests := []struct {
+		name      string
+		upstreams []*testUpstream
+		rcode     int
+		addresses []string
+		err       bool
+	}{
+		{
+			name: "valid answer after invalid one",
+			upstreams: []*testUpstream{
+				{rcode: dns.RcodeServerFailure},
+				{addresses: []string{"10.0.0.2"}, delay: 20 * time.Millisecond},
+			},
+			rcode:     dns.RcodeSuccess,
+			addresses: []string{"10.0.0.2"},
+		},
+		{
+			name: "fastest valid answer",
+			upstreams: []*testUpstream{
+				{addresses: []string{"10.0.0.1"}, delay: time.Second},
+				{addresses: []string{"10.0.0.2"}},
+			},
+			rcode:     dns.RcodeSuccess,
+			addresses: []string{"10.0.0.2"},
+		},
+		{
+			name: "nxdomain is valid answer",
+			upstreams: []*testUpstream{
+				{rcode: dns.RcodeNameError},
+				{addresses: []string{"10.0.0.2"}, delay: time.Second},
+			},
+			rcode:     dns.RcodeNameError,
+			addresses: []string{},
+		},
+		{
+			name: "fallback to invalid answer",
+			upstreams: []*testUpstream{
+				{err: errTestUpstream},
+				{rcode: dns.RcodeRefused, delay: 10 * time.Millisecond},
+				{rcode: dns.RcodeServerFailure, delay: 20 * time.Millisecond},
+			},
+			rcode:     dns.RcodeRefused,
+			addresses: []string{},
+		},
+		{
+			name: "every upstream failed",
+			upstreams: []*testUpstream{
+				{err: errTestUpstream},
+				{err: errTestUpstream},
+			},
+			err: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pool := makeTestPool(t, StrategyParallel, test.upstreams...)
+
+			start := time.Now()
+			response, err := testExchange(pool)
+			if test.err {
+				if !errors.Is(err, errNoUpstream) {
+					t.Fatalf("error = %v, want %v", err, errNoUpstream)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Slow upstreams are not waited for
+			if elapsed := time.Since(start); elapsed >= time.Second {
+				t.Errorf("exchange took %v", elapsed)
+			}
+
+			if response.Rcode != test.rcode {
+				t.Errorf("rcode = %s, want %s", dns.RcodeToString[response.Rcode], dns.RcodeToString[test.rcode])
+			}
+			if addresses := testAddresses(response); !slices.Equal(addresses, test.addresses) {
+				t.Errorf("addresses = %v, want %v", addresses, test.addresses)
+			}
+
+			// Every upstream is queried at once, slow ones may be starting yet
+			for i, u := range test.upstreams {
+				deadline := time.Now().Add(time.Second)
+				for u.exchanges.Load() == 0 && time.Now().Before(deadline) {
+					time.Sleep(time.Millisecond)
+				}
+				if u.exchanges.Load() != 1 {
+					t.Errorf("upstream %d exchanges = %d, want 1", i, u.exchanges.Load())
+				}
+			}
+		})
+	}
+}
+
+func TestPoolRoundRobin(t *testing.T) {
+	a := &testUpstream{addresses: []string{"10.0.0.1"}}
+	b := &testUpstream{addresses: []string{"10.0.0.2"}}
+	c := &testUpstream{addresses: []string{"10.0.0.3"}}
+	pool := makeTestPool(t, StrategyRoundRobin, a, b, c)
+
+	answered := make([]string, 0)
+	for range 6 {
+		response, err := testExchange(pool)
+		if err != nil {
+			t.Fatal(err)
+		}
+		answered = append(answered, testAddresses(response)...)
+	}
+
+	want := []string{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.1", "10.0.0.2", "10.0.0.3"}
+	if !slices.Equal(answered, want) {
+		t.Errorf("answered = %v, want %v", answered, want)
+	}
+
+	// Failed upstream passes query to next one
+	b.err = errTestUpstream
+	answered = answered[:0]
+	for range 3 {
+		response, err := testExchange(pool)
+		if err != nil {
+			t.Fatal(err)
+		}
+		answered = append(answered, testAddresses(response)...)
+	}
+
+	want = []string{"10.0.0.1", "10.0.0.3", "10.0.0.3"}
+	if !slices.Equal(answered, want) {
+		t.Errorf("answered with failed upstream = %v, want %v", answered, want)
+	}
+}
+
+func TestPoolFastest(t *testing.T) {
+	slow := &testUpstream{name: "slow", addresses: []string{"10.0.0.1"}}
+	fast := &testUpstream{name: "fast", addresses: []string{"10.0.0.2"}}
+	pool := makeTestPool(t, StrategyFastest, slow, fast)
+
+	pool.upstreams[0].latency.Store(int64(50 * time.Millisecond))
+	pool.upstreams[1].latency.Store(int64(10 * time.Millisecond))
+
+	response, err := testExchange(pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addresses := testAddresses(response); !slices.Equal(addresses, []string{"10.0.0.2"}) {
+		t.Errorf("addresses = %v, want fastest upstream", addresses)
+	}
+	if slow.exchanges.Load() != 0 {
+		t.Errorf("slow upstream exchanges = %d", slow.exchanges.Load())
+	}
+
+	// Failure penalty moves upstream behind others
+	fast.err = errTestUpstream
+	response, err = testExchange(pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addresses := testAddresses(response); !slices.Equal(addresses, []string{"10.0.0.1"}) {
+		t.Errorf("addresses = %v, want fallback to slow upstream", addresses)
+	}
+
+	ordered := pool.ordered()
+	if ordered[0].String() != "slow" || ordered[1].String() != "fast" {
+		t.Errorf("order = %s, %s", ordered[0], ordered[1])
+	}
+}
+
+func TestPoolSkipDown(t *testing.T) {
+	for _, strategy := range []string{StrategySequential, StrategyParallel, StrategyRoundRobin, StrategyFastest} {
+		t.Run(strategy, func(t *testing.T) {
+			down := &testUpstream{addresses: []string{"10.0.0.1"}}
+			up := &testUpstream{addresses: []string{"10.0.0.2"}}
+			pool := makeTestPool(t, strategy, down, up)
+			pool.upstreams[0].down.Store(true)
+
+			for range 2 {
+				response, err := testExchange(pool)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if addresses := testAddresses(response); !slices.Equal(addresses, []string{"10.0.0.2"}) {
+					t.Errorf("addresses = %v", addresses)
+				}
+			}
+			if down.exchanges.Load() != 0 {
+				t.Errorf("down upstream exchanges = %d", down.exchanges.Load())
+			}
+
+			// Every upstream is tried when all are down
+			pool.upstreams[1].down.Store(true)
+			up.err = errTestUpstream
+
+			response, err := testExchange(pool)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if addresses := testAddresses(response); !slices.Equal(addresses, []string{"10.0.0.1"}) {
+				t.Errorf("addresses with all down = %v", addresses)
+			}
+		})
+	}
+}
@@ -0,0 +1,221 @@
+// dnsilly - dns automation utility
+// Copyright (C) 2025  bitrate16 (bitrate16@gmail.com)
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"container/list"
+	"dnsilly/triggers"
+	"dnsilly/util"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Domain with addresses triggers acted on
+type observation struct {
+	Tag      string    `json:"tag"`
+	Qtype    uint16    `json:"qtype,omitempty"`
+	Domain   string    `json:"domain"`
+	Chain    []string  `json:"chain"`
+	Ipv4     []string  `json:"ipv4"`
+	Ipv6     []string  `json:"ipv6"`
+	ClientIP string    `json:"client_ip"`
+	Seen     time.Time `json:"seen"`
+}
+
+type observationKey struct {
+	tag    string
+	domain string
+}
+
+// Latest observation per rule tag and domain
+type observations struct {
+	items map[observationKey]*list.Element
+	// Least recently seen at back
+	order *list.List
+	lock  sync.Mutex
+
+	// Max observations, not limited if not positive
+	maxEntries int
+}
+
+func newObservations(maxEntries int) *observations {
+	return &observations{
+		items:      make(map[observationKey]*list.Element),
+		order:      list.New(),
+		maxEntries: maxEntries,
+	}
+}
+
+// Remember observation, least recently seen ones are dropped over limit.
+// Observations are not kept without state.
+func (o *observations) Add(obs *observation) {
+	if o == nil {
+		return
+	}
+
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	key := observationKey{obs.Tag, obs.Domain}
+	if element, ok := o.items[key]; ok {
+		element.Value = obs
+		o.order.MoveToFront(element)
+		return
+	}
+
+	o.items[key] = o.order.PushFront(obs)
+
+	for o.maxEntries > 0 && o.order.Len() > o.maxEntries {
+		element := o.order.Back()
+		o.order.Remove(element)
+
+		dropped := element.Value.(*observation)
+		delete(o.items, observationKey{dropped.Tag, dropped.Domain})
+	}
+}
+
+// Observations from least to most recently seen
+func (o *observations) List() []*observation {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	observed := make([]*observation, 0, o.order.Len())
+	for element := o.order.Back(); element != nil; element = element.Prev() {
+		observed = append(observed, element.Value.(*observation))
+	}
+
+	return observed
+}
+
+// Cached response in snapshot
+type snapshotCacheEntry struct {
+	// Response in wire format
+	Response []byte    `json:"response"`
+	Stored   time.Time `json:"stored"`
+	Expires  time.Time `json:"expires"`
+	Hits     int       `json:"hits"`
+}
+
+// On-disk server state
+type snapshot struct {
+	Cache        []*snapshotCacheEntry `json:"cache"`
+	Observations []*observation        `json:"observations"`
+}
+
+// Write state snapshot to configured path
+func (s *Server) saveState() error {
+	state := &snapshot{
+		Cache:        make([]*snapshotCacheEntry, 0),
+		Observations: s.observations.List(),
+	}
+
+	if s.cache != nil {
+		for _, entry := range s.cache.Entries() {
+			data, err := entry.response.Pack()
+			if err != nil {
+				continue
+			}
+
+			state.Cache = append(state.Cache, &snapshotCacheEntry{
+				Response: data,
+				Stored:   entry.stored,
+				Expires:  entry.expires,
+				Hits:     entry.hits,
+			})
+		}
+	}
+
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	// Replace old snapshot only when new one is complete
+	tmpPath := s.config.State.Path + ".tmp"
+	err = os.WriteFile(tmpPath, data, 0600)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmpPath, s.config.State.Path)
+}
+
+// Read state snapshot from configured path, missing snapshot is not an error.
+// Returns loaded observations.
+func (s *Server) loadState() ([]*observation, error) {
+	data, err := os.ReadFile(s.config.State.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	state := &snapshot{}
+	err = json.Unmarshal(data, state)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, obs := range state.Observations {
+		s.observations.Add(obs)
+	}
+
+	if s.cache != nil {
+		entries := make([]*cacheEntry, 0, len(state.Cache))
+		for _, snapshotEntry := range state.Cache {
+			response := &dns.Msg{}
+			if response.Unpack(snapshotEntry.Response) != nil || len(response.Question) != 1 {
+				continue
+			}
+
+			entries = append(entries, &cacheEntry{
+				key:      makeCacheKey(response.Question[0]),
+				response: response,
+				stored:   snapshotEntry.Stored,
+				expires:  snapshotEntry.Expires,
+				hits:     snapshotEntry.Hits,
+			})
+		}
+		s.cache.Restore(entries)
+	}
+
+	if s.config.Verbose {
+		fmt.Printf("[%s] Loaded state: %d cached responses, %d observations\n", util.Now(), len(state.Cache), len(state.Observations))
+	}
+
+	return state.Observations, nil
+}
+
+// Fire triggers again for domains still matching rules with same tag
+func (s *Server) replayObservations(loaded []*observation) {
+	dnsRules := s.rules.Load()
+	for _, obs := range loaded {
+		for _, rule := range dnsRules.Match([]byte(obs.Domain), obs.Qtype, net.ParseIP(obs.ClientIP)) {
+			if rule.Tag == obs.Tag {
+				triggers.TriggerEvent(s.config, rule, obs.Domain, obs.Chain, obs.Ipv4, obs.Ipv6, obs.ClientIP)
+			}
+		}
+	}
+}
@@ -0,0 +1,113 @@
+// dnsilly - dns automation utility
+// Copyright (C) 2025  bitrate16 (bitrate16@gmail.com)
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"dnsilly/config"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"testing"
+)
+
+// Domains of observations in list order
+func observedDomains(list []*observation) []string {
+	domains := make([]string, 0, len(list))
+	for _, obs := range list {
+		domains = append(domains, obs.Domain)
+	}
+
+	return domains
+}
+
+func TestObservationsLimit(t *testing.T) {
+	o := newObservations(3)
+
+	for _, domain := range []string{"a.test", "b.test", "c.test", "a.test", "d.test"} {
+		o.Add(&observation{Tag: "log", Domain: domain})
+	}
+
+	// Least recently seen "b.test" dropped, "a.test" was seen again
+	if domains := observedDomains(o.List()); !slices.Equal(domains, []string{"c.test", "a.test", "d.test"}) {
+		t.Errorf("observations = %v", domains)
+	}
+
+	// Same domain with other tag is separate observation
+	o.Add(&observation{Tag: "block", Domain: "d.test"})
+	if list := o.List(); len(list) != 3 || list[2].Tag != "block" || list[1].Tag != "log" {
+		t.Errorf("observations = %v", observedDomains(list))
+	}
+
+	// Without state observations are not kept
+	var disabled *observations
+	disabled.Add(&observation{Tag: "log", Domain: "a.test"})
+}
+
+func TestObservationsUnlimited(t *testing.T) {
+	o := newObservations(-1)
+
+	for i := range 100 {
+		o.Add(&observation{Tag: "log", Domain: strconv.Itoa(i) + ".test"})
+	}
+
+	// Latest observation replaces previous one
+	o.Add(&observation{Tag: "log", Domain: "0.test", ClientIP: "10.0.0.1"})
+
+	list := o.List()
+	if len(list) != 100 {
+		t.Fatalf("observations = %d, want 100", len(list))
+	}
+	if list[99].Domain != "0.test" || list[99].ClientIP != "10.0.0.1" {
+		t.Errorf("latest observation = %+v", list[99])
+	}
+}
+
+func TestStateRoundTrip(t *testing.T) {
+	conf := &config.Config{
+		State: &config.ConfigState{
+			Path:            filepath.Join(t.TempDir(), "dnsilly.state"),
+			MaxObservations: 2,
+		},
+	}
+
+	saved := &Server{config: conf, observations: newObservations(conf.State.MaxObservations)}
+	for _, domain := range []string{"a.test", "b.test", "c.test"} {
+		saved.observations.Add(&observation{Tag: "log", Domain: domain, Ipv4: []string{"10.0.0.1"}})
+	}
+	if err := saved.saveState(); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded := &Server{config: conf, observations: newObservations(conf.State.MaxObservations)}
+	list, err := loaded.loadState()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if domains := observedDomains(list); !slices.Equal(domains, []string{"b.test", "c.test"}) {
+		t.Errorf("loaded observations = %v", domains)
+	}
+	if domains := observedDomains(loaded.observations.List()); !slices.Equal(domains, []string{"b.test", "c.test"}) {
+		t.Errorf("restored observations = %v", domains)
+	}
+
+	// Missing snapshot is not an error
+	conf.State.Path = filepath.Join(t.TempDir(), "missing.state")
+	if list, err := loaded.loadState(); err != nil || len(list) != 0 {
+		t.Errorf("missing snapshot: %v, %v", list, err)
+	}
+}
@@ -17,24 +17,51 @@
 package server
 
 import (
+	"context"
+	"crypto/tls"
 	"dnsilly/config"
 	"dnsilly/rules"
 	"dnsilly/util"
 	"errors"
 	"fmt"
+	"net"
+	"net/http"
 	"strconv"
 	"sync"
+	"sync/atomic"
 
 	"github.com/miekg/dns"
 )
 
 type Server struct {
 	config  *config.Config
-	rules   *rules.Rules
-	server  *dns.Server
+	servers []*dns.Server
 	running bool
 	lock    sync.Mutex
-	client  *dns.Client
+
+	// DNS-over-HTTPS server, optional
+	httpServer *http.Server
+
+	// Rules replaced while server is running
+	rules atomic.Pointer[rules.Rules]
+
+	// Upstreams queried with configured strategy
+	upstreams *upstreamPool
+
+	// Named upstream groups for conditional forwarding
+	groups map[string]*upstreamPool
+
+	// Domain patterns mapped to upstream groups, group name is rule tag
+	forward *rules.Rules
+
+	// Response cache, optional
+	cache *cache
+
+	// Domains triggers acted on
+	observations *observations
+
+	// Channel to stop health check
+	onStopHealthCheck chan struct{}
 
 	// Channel to be used for server exit
 	onExited chan struct{}
@@ -48,6 +75,32 @@ func NewServer(
 	}
 }
 
+// Listener protocols from config, udp only by default
+func (s *Server) protocols() ([]string, error) {
+	if len(s.config.Server.Protocols) == 0 {
+		return []string{"udp"}, nil
+	}
+
+	for _, proto := range s.config.Server.Protocols {
+		if proto != "udp" && proto != "tcp" {
+			return nil, fmt.Errorf("unsupported server protocol: %s", proto)
+		}
+	}
+
+	return s.config.Server.Protocols, nil
+}
+
+// Shutdown all listeners, errors from not started listeners are ignored
+func (s *Server) shutdown() {
+	for _, server := range s.servers {
+		server.Shutdown()
+	}
+
+	if s.httpServer != nil {
+		s.httpServer.Shutdown(context.Background())
+	}
+}
+
 func (s *Server) Start() error {
 	s.lock.Lock()
 
@@ -55,6 +108,43 @@ func (s *Server) Start() error {
 		s.lock.Unlock()
 		return errors.New("server is running")
 	}
+
+	protocols, err := s.protocols()
+	if err != nil {
+		s.lock.Unlock()
+		return err
+	}
+
+	err = s.setupUpstreams()
+	if err != nil {
+		s.lock.Unlock()
+		return err
+	}
+
+	if s.config.Block != nil {
+		err = validateBlock(s.config.Block)
+		if err != nil {
+			s.lock.Unlock()
+			return err
+		}
+	}
+
+	s.cache = nil
+	if s.config.Cache != nil {
+		s.cache = newCache(s.config.Cache)
+	}
+
+	// Observations are kept only for state snapshot
+	s.observations = nil
+	var loaded []*observation
+	if s.config.State != nil {
+		s.observations = newObservations(s.config.State.MaxObservations)
+
+		loaded, err = s.loadState()
+		if err != nil {
+			fmt.Printf("[%s] Error while loading state: %v\n", util.Now(), err)
+		}
+	}
 	s.running = true
 
 	// Register handlers
@@ -64,25 +154,145 @@ func (s *Server) Start() error {
 		chain.Add(logHandler)
 	}
 
-	chain.Add(s.proxyHandler)
+	chain.Add(s.localHandler)
+
+	if s.config.Block != nil {
+		chain.Add(s.blockHandler)
+	}
 
-	dns.Handle(".", chain)
+	chain.Add(s.proxyHandler)
 
-	// Create server
+	// Create servers sharing same handler chain
 	addr := s.config.Server.Host + ":" + strconv.Itoa(s.config.Server.Port)
-	s.client = new(dns.Client)
-	s.server = &dns.Server{
-		Addr: addr,
-		Net:  "udp",
+	s.servers = make([]*dns.Server, 0, len(protocols))
+	for _, proto := range protocols {
+		s.servers = append(s.servers, &dns.Server{
+			Addr:    addr,
+			Net:     proto,
+			Handler: chain,
+		})
+	}
+
+	// DNS-over-TLS listener
+	if s.config.Server.TLS != nil {
+		cert, err := tls.LoadX509KeyPair(s.config.Server.TLS.Cert, s.config.Server.TLS.Key)
+		if err != nil {
+			s.running = false
+			s.lock.Unlock()
+			return err
+		}
+
+		s.servers = append(s.servers, &dns.Server{
+			Addr: s.config.Server.Host + ":" + strconv.Itoa(s.config.Server.TLS.Port),
+			Net:  "tcp-tls",
+			TLSConfig: &tls.Config{
+				Certificates: []tls.Certificate{cert},
+			},
+			Handler: chain,
+		})
+	}
+
+	// DNS-over-HTTPS listener
+	s.httpServer = nil
+	if s.config.Server.HTTPS != nil {
+		cert, err := tls.LoadX509KeyPair(s.config.Server.HTTPS.Cert, s.config.Server.HTTPS.Key)
+		if err != nil {
+			s.running = false
+			s.lock.Unlock()
+			return err
+		}
+
+		mux := http.NewServeMux()
+		mux.Handle(s.config.Server.HTTPS.Path, &dohHandler{
+			chain: chain,
+		})
+
+		s.httpServer = &http.Server{
+			Addr:    s.config.Server.Host + ":" + strconv.Itoa(s.config.Server.HTTPS.Port),
+			Handler: mux,
+			TLSConfig: &tls.Config{
+				Certificates: []tls.Certificate{cert},
+			},
+		}
+	}
+
+	// Start health check
+	if s.config.HealthCheck != nil {
+		s.onStopHealthCheck = make(chan struct{})
+		go s.runHealthCheck(s.config.HealthCheck, s.onStopHealthCheck)
 	}
 
 	// Make exit callback channel
 	s.onExited = make(chan struct{}, 1)
 	s.lock.Unlock()
 
-	// Start server
-	fmt.Printf("[%s] Listening on %s\n", util.Now(), addr)
-	err := s.server.ListenAndServe()
+	count := len(s.servers)
+	if s.httpServer != nil {
+		count += 1
+	}
+
+	// Listeners done starting, failed to start ones included
+	var started sync.WaitGroup
+	var failed atomic.Bool
+	started.Add(count)
+
+	// Start servers
+	onServerExited := make(chan error, count)
+	for _, server := range s.servers {
+		var notify sync.Once
+		server.NotifyStartedFunc = func() {
+			notify.Do(started.Done)
+		}
+
+		go func() {
+			fmt.Printf("[%s] Listening on %s/%s\n", util.Now(), server.Net, server.Addr)
+			err := server.ListenAndServe()
+			if err != nil {
+				failed.Store(true)
+			}
+			notify.Do(started.Done)
+			onServerExited <- err
+		}()
+	}
+
+	if s.httpServer != nil {
+		go func() {
+			fmt.Printf("[%s] Listening on https/%s%s\n", util.Now(), s.httpServer.Addr, s.config.Server.HTTPS.Path)
+			listener, err := net.Listen("tcp", s.httpServer.Addr)
+			if err != nil {
+				failed.Store(true)
+				started.Done()
+				onServerExited <- err
+				return
+			}
+			started.Done()
+
+			err = s.httpServer.ServeTLS(listener, "", "")
+			if errors.Is(err, http.ErrServerClosed) {
+				err = nil
+			}
+			onServerExited <- err
+		}()
+	}
+
+	// Replay observations once clients can be served
+	if len(loaded) != 0 && s.config.State.Replay {
+		go func() {
+			started.Wait()
+			if !failed.Load() {
+				s.replayObservations(loaded)
+			}
+		}()
+	}
+
+	// Wait for all servers, failure of one stops the rest
+	for range count {
+		serverErr := <-onServerExited
+		if serverErr != nil && err == nil {
+			err = serverErr
+			s.shutdown()
+		}
+	}
 	s.onExited <- struct{}{}
 
 	return err
@@ -97,14 +307,31 @@ func (s *Server) Stop() error {
 	}
 	s.running = false
 
-	s.server.Shutdown()
+	s.shutdown()
 	<-s.onExited
 
+	if s.onStopHealthCheck != nil {
+		close(s.onStopHealthCheck)
+		s.onStopHealthCheck = nil
+	}
+
+	if s.config.State != nil {
+		err := s.saveState()
+		if err != nil {
+			fmt.Printf("[%s] Error while saving state: %v\n", util.Now(), err)
+		}
+	}
+
+	for _, pool := range s.pools() {
+		pool.Close()
+	}
+
 	fmt.Printf("[%s] %s\n", util.Now(), "Server stopped")
 
 	return nil
 }
 
+// Replace rules, safe to call while server is running
 func (s *Server) SetRules(r *rules.Rules) {
-	s.rules = r
+	s.rules.Store(r)
 }
@@ -0,0 +1,212 @@
+// dnsilly - dns automation utility
+// Copyright (C) 2025  bitrate16 (bitrate16@gmail.com)
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"bytes"
+	"crypto/tls"
+	"dnsilly/config"
+	"dnsilly/util"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// DNS resolver queries are forwarded to
+type upstream interface {
+	Exchange(request *dns.Msg) (*dns.Msg, error)
+	String() string
+
+	// Release kept connections
+	Close()
+}
+
+func newUpstream(conf *config.ConfigUpstream, verbose bool) (upstream, error) {
+	if conf.URL == "" {
+		return newPlainUpstream(conf.Host, conf.Port, conf.Timeout, verbose), nil
+	}
+
+	u, err := url.Parse(conf.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	switch u.Scheme {
+	case "https":
+		tlsConfig, err := makeUpstreamTLSConfig(conf, u.Hostname())
+		if err != nil {
+			return nil, err
+		}
+
+		return newDoHUpstream(conf.URL, tlsConfig, conf.Timeout), nil
+	case "tls":
+		tlsConfig, err := makeUpstreamTLSConfig(conf, u.Hostname())
+		if err != nil {
+			return nil, err
+		}
+
+		port := u.Port()
+		if port == "" {
+			port = "853"
+		}
+
+		return newDoTUpstream(net.JoinHostPort(u.Hostname(), port), tlsConfig, conf.Timeout), nil
+	default:
+		return nil, fmt.Errorf("unsupported upstream scheme: %s", u.Scheme)
+	}
+}
+
+// Plain DNS over UDP with TCP retry for truncated responses
+type plainUpstream struct {
+	addr      string
+	verbose   bool
+	client    *dns.Client
+	tcpClient *dns.Client
+}
+
+func newPlainUpstream(host string, port int, timeout time.Duration, verbose bool) *plainUpstream {
+	return &plainUpstream{
+		addr:    net.JoinHostPort(host, strconv.Itoa(port)),
+		verbose: verbose,
+		client: &dns.Client{
+			Timeout: timeout,
+		},
+		tcpClient: &dns.Client{
+			Net:     "tcp",
+			Timeout: timeout,
+		},
+	}
+}
+
+func (u *plainUpstream) String() string {
+	return u.addr
+}
+
+func (u *plainUpstream) Close() {}
+
+func (u *plainUpstream) Exchange(request *dns.Msg) (*dns.Msg, error) {
+	response, _, err := u.client.Exchange(request, u.addr)
+	if err != nil {
+		return nil, err
+	}
+
+	// Retry over TCP to get full answer
+	if response.Truncated {
+		if u.verbose {
+			fmt.Printf("[%s] Upstream %s response truncated, retrying over tcp\n", util.Now(), u.addr)
+		}
+
+		tcpResponse, _, err := u.tcpClient.Exchange(request, u.addr)
+		if err != nil {
+			fmt.Printf("[%s] Upstream %s not available over tcp: %v\n", util.Now(), u.addr, err)
+		} else {
+			response = tcpResponse
+		}
+	}
+
+	return response, nil
+}
+
+// DNS-over-HTTPS as defined in RFC 8484
+type dohUpstream struct {
+	url       string
+	client    *http.Client
+	transport *http.Transport
+}
+
+// Default timeout for encrypted upstreams
+const defaultUpstreamTimeout = 5 * time.Second
+
+func newDoHUpstream(url string, tlsConfig *tls.Config, timeout time.Duration) *dohUpstream {
+	if timeout == 0 {
+		timeout = defaultUpstreamTimeout
+	}
+
+	// Keep connections alive between queries
+	transport := &http.Transport{
+		TLSClientConfig:     tlsConfig,
+		ForceAttemptHTTP2:   true,
+		MaxIdleConnsPerHost: 16,
+		IdleConnTimeout:     90 * time.Second,
+	}
+
+	return &dohUpstream{
+		url: url,
+		client: &http.Client{
+			Timeout:   timeout,
+			Transport: transport,
+		},
+		transport: transport,
+	}
+}
+
+func (u *dohUpstream) String() string {
+	return u.url
+}
+
+func (u *dohUpstream) Close() {
+	u.transport.CloseIdleConnections()
+}
+
+func (u *dohUpstream) Exchange(request *dns.Msg) (*dns.Msg, error) {
+	// Use zero ID to make responses cache friendly
+	query := request.Copy()
+	query.Id = 0
+
+	data, err := query.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	httpRequest, err := http.NewRequest(http.MethodPost, u.url, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	httpRequest.Header.Set("Content-Type", dohContentType)
+	httpRequest.Header.Set("Accept", dohContentType)
+
+	httpResponse, err := u.client.Do(httpRequest)
+	if err != nil {
+		return nil, err
+	}
+	defer httpResponse.Body.Close()
+
+	if httpResponse.StatusCode != http.StatusOK {
+		io.Copy(io.Discard, httpResponse.Body)
+		return nil, fmt.Errorf("unexpected status: %s", httpResponse.Status)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(httpResponse.Body, dns.MaxMsgSize))
+	if err != nil {
+		return nil, err
+	}
+
+	response := &dns.Msg{}
+	err = response.Unpack(body)
+	if err != nil {
+		return nil, err
+	}
+	response.Id = request.Id
+
+	return response, nil
+}
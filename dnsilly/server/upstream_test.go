@@ -0,0 +1,253 @@
+// dnsilly - dns automation utility
+// Copyright (C) 2025  bitrate16 (bitrate16@gmail.com)
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"crypto/tls"
+	"dnsilly/config"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// DNS-over-HTTPS resolver stand-in answering every query with single address
+type testDoHServer struct {
+	*httptest.Server
+
+	mu sync.Mutex
+
+	// Status replied instead of answer if set
+	status int
+
+	// Received queries with request content types
+	queries      []*dns.Msg
+	contentTypes []string
+
+	// Accepted connections
+	conns int
+}
+
+func makeTestDoHServer(t *testing.T, cert tls.Certificate) *testDoHServer {
+	t.Helper()
+
+	s := &testDoHServer{}
+	s.Server = httptest.NewUnstartedServer(http.HandlerFunc(s.serveHTTP))
+	s.Server.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+	s.Server.Config.ErrorLog = log.New(io.Discard, "", 0)
+	s.Server.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			s.mu.Lock()
+			s.conns++
+			s.mu.Unlock()
+		}
+	}
+	s.Server.StartTLS()
+	t.Cleanup(s.Server.Close)
+
+	return s
+}
+
+func (s *testDoHServer) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	request := &dns.Msg{}
+	if err := request.Unpack(body); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	s.queries = append(s.queries, request)
+	s.contentTypes = append(s.contentTypes, r.Header.Get("Content-Type"))
+	status := s.status
+	s.mu.Unlock()
+
+	if status != 0 {
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+
+	data, err := makeTestResponse(request, dns.RcodeSuccess, "10.0.0.1").Pack()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", dohContentType)
+	w.Write(data)
+}
+
+// DNS-over-HTTPS upstream trusting certificate of stand-in server
+func makeTestDoHUpstream(t *testing.T, server *testDoHServer, root *testCert) upstream {
+	t.Helper()
+
+	u, err := newUpstream(&config.ConfigUpstream{
+		URL:        server.URL + "/dns-query",
+		ServerName: testServerName,
+		CAFile:     root.writePEM(t),
+	}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(u.Close)
+
+	return u
+}
+
+func TestDoHUpstreamExchange(t *testing.T) {
+	root := makeTestCert(t, "root", true, nil)
+	server := makeTestDoHServer(t, makeTestCert(t, "leaf", false, root).tlsCertificate())
+	u := makeTestDoHUpstream(t, server, root)
+
+	for i := range 3 {
+		request := &dns.Msg{}
+		request.SetQuestion("doh.test.", dns.TypeA)
+		request.Id = uint16(1000 + i)
+
+		response, err := u.Exchange(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Client sees own ID while upstream got cache friendly zero ID
+		if response.Id != request.Id {
+			t.Errorf("response id = %d, want %d", response.Id, request.Id)
+		}
+		if addresses := testAddresses(response); !slices.Equal(addresses, []string{"10.0.0.1"}) {
+			t.Errorf("addresses = %v", addresses)
+		}
+	}
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	if len(server.queries) != 3 {
+		t.Fatalf("queries = %d, want 3", len(server.queries))
+	}
+	for i, query := range server.queries {
+		if query.Id != 0 || query.Question[0].Name != "doh.test." {
+			t.Errorf("query id = %d, name = %s", query.Id, query.Question[0].Name)
+		}
+		if server.contentTypes[i] != dohContentType {
+			t.Errorf("content type = %s", server.contentTypes[i])
+		}
+	}
+
+	// Connection is kept alive between queries
+	if server.conns != 1 {
+		t.Errorf("connections = %d, want 1", server.conns)
+	}
+}
+
+func TestDoHUpstreamStatus(t *testing.T) {
+	root := makeTestCert(t, "root", true, nil)
+	server := makeTestDoHServer(t, makeTestCert(t, "leaf", false, root).tlsCertificate())
+	server.status = http.StatusBadGateway
+	u := makeTestDoHUpstream(t, server, root)
+
+	request := &dns.Msg{}
+	request.SetQuestion("doh.test.", dns.TypeA)
+
+	response, err := u.Exchange(request)
+	if err == nil {
+		t.Fatalf("expected error, got response %v", response)
+	}
+	if !strings.Contains(err.Error(), "502") {
+		t.Errorf("error = %v, want status", err)
+	}
+}
+
+func TestDoHUpstreamTLSConfig(t *testing.T) {
+	root := makeTestCert(t, "root", true, nil)
+	leaf := makeTestCert(t, "leaf", false, root)
+	other := makeTestCert(t, "other", false, nil)
+
+	server := makeTestDoHServer(t, leaf.tlsCertificate())
+	caFile := root.writePEM(t)
+
+	tests := []struct {
+		name    string
+		conf    *config.ConfigUpstream
+		success bool
+	}{
+		{
+			name:    "system roots",
+			conf:    &config.ConfigUpstream{ServerName: testServerName},
+			success: false,
+		},
+		{
+			name:    "ca file",
+			conf:    &config.ConfigUpstream{ServerName: testServerName, CAFile: caFile},
+			success: true,
+		},
+		{
+			name:    "ca file with other server name",
+			conf:    &config.ConfigUpstream{ServerName: "other.test", CAFile: caFile},
+			success: false,
+		},
+		{
+			name:    "pinned leaf",
+			conf:    &config.ConfigUpstream{SPKIPin: leaf.pin()},
+			success: true,
+		},
+		{
+			name:    "other pin",
+			conf:    &config.ConfigUpstream{SPKIPin: other.pin()},
+			success: false,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.conf.URL = server.URL + "/dns-query"
+
+			u, err := newUpstream(test.conf, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer u.Close()
+
+			request := &dns.Msg{}
+			request.SetQuestion("doh.test.", dns.TypeA)
+
+			_, err = u.Exchange(request)
+			if test.success && err != nil {
+				t.Errorf("exchange failed: %v", err)
+			}
+			if !test.success && err == nil {
+				t.Error("exchange succeeded")
+			}
+		})
+	}
+}
@@ -25,6 +25,7 @@ import (
 	"fmt"
 	"os"
 	"os/exec"
+	"regexp"
 	"strings"
 )
 
@@ -103,7 +104,17 @@ func partialTriggerEventCommand(conf *config.Config, cmdConf *config.ConfigTrigg
 	return nil
 }
 
-func TriggerEventCommand(conf *config.Config, cmdConf *config.ConfigTriggerCommand, rule *rules.Rule, domain string, ipv4 []string, ipv6 []string, client_ip string) error {
+// Placeholder of rule metadata value
+var metaPlaceholder = regexp.MustCompile(`\{meta\.([^{}]*)\}`)
+
+// Replace {meta.<key>} with metadata value, missing keys are replaced with empty string
+func replaceMeta(command string, meta map[string]string) string {
+	return metaPlaceholder.ReplaceAllStringFunc(command, func(placeholder string) string {
+		return meta[metaPlaceholder.FindStringSubmatch(placeholder)[1]]
+	})
+}
+
+func TriggerEventCommand(conf *config.Config, cmdConf *config.ConfigTriggerCommand, rule *rules.Rule, domain string, chain []string, ipv4 []string, ipv6 []string, client_ip string) error {
 	if !hasShell {
 		return errors.New("shell not found")
 	}
@@ -115,7 +126,14 @@ func TriggerEventCommand(conf *config.Config, cmdConf *config.ConfigTriggerComma
 	command := cmdConf.EventTemplate
 	command = strings.ReplaceAll(command, "{tag}", rule.Tag)
 	command = strings.ReplaceAll(command, "{domain}", domain)
+	command = strings.ReplaceAll(command, "{chain}", strings.Join(chain, ","))
 	command = strings.ReplaceAll(command, "{client_ip}", client_ip)
+	command = replaceMeta(command, rule.Meta)
+	if conf.Trigger.Unicode {
+		command = strings.ReplaceAll(command, "{domain_unicode}", unicodeDomain(domain))
+	} else {
+		command = strings.ReplaceAll(command, "{domain_unicode}", domain)
+	}
 
 	err := partialTriggerEventCommand(conf, cmdConf, command, ipv4, "A")
 	if err != nil {
@@ -125,7 +143,7 @@ func TriggerEventCommand(conf *config.Config, cmdConf *config.ConfigTriggerComma
 	return partialTriggerEventCommand(conf, cmdConf, command, ipv6, "AAAA")
 }
 
-func TriggerLifecycleCommand(conf *config.Config, cmdConf *config.ConfigTriggerCommand, state string) error {
+func TriggerLifecycleCommand(conf *config.Config, cmdConf *config.ConfigTriggerCommand, state string, upstream string) error {
 	if !hasShell {
 		return errors.New("shell not found")
 	}
@@ -159,6 +177,20 @@ func TriggerLifecycleCommand(conf *config.Config, cmdConf *config.ConfigTriggerC
 		}
 	}
 
+	if (state == OnUpstreamDown) && (cmdConf.OnUpstreamDown != "") {
+		err := executeForError(strings.ReplaceAll(cmdConf.OnUpstreamDown, "{upstream}", upstream), conf.Verbose)
+		if err != nil {
+			return err
+		}
+	}
+
+	if (state == OnUpstreamUp) && (cmdConf.OnUpstreamUp != "") {
+		err := executeForError(strings.ReplaceAll(cmdConf.OnUpstreamUp, "{upstream}", upstream), conf.Verbose)
+		if err != nil {
+			return err
+		}
+	}
+
 	// Execute handler script
 	if cmdConf.LifecycleTemplate == "" {
 		return nil
@@ -166,6 +198,7 @@ func TriggerLifecycleCommand(conf *config.Config, cmdConf *config.ConfigTriggerC
 
 	command := cmdConf.LifecycleTemplate
 	command = strings.ReplaceAll(command, "{state}", state)
+	command = strings.ReplaceAll(command, "{upstream}", upstream)
 
 	return executeForError(command, conf.Verbose)
 }
@@ -0,0 +1,92 @@
+// dnsilly - dns automation utility
+// Copyright (C) 2025  bitrate16 (bitrate16@gmail.com)
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package triggers
+
+import (
+	"dnsilly/config"
+	"dnsilly/rules"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReplaceMeta(t *testing.T) {
+	meta := map[string]string{"iface": "wg0", "table": "100", "empty": ""}
+
+	tests := []struct {
+		command string
+		want    string
+	}{
+		{"ip route add {ip} dev {meta.iface} table {meta.table}", "ip route add {ip} dev wg0 table 100"},
+		{"echo {meta.iface}{meta.iface}", "echo wg0wg0"},
+		{"echo [{meta.missing}] [{meta.empty}]", "echo [] []"},
+		{"echo {meta.}", "echo "},
+		{"echo {meta.iface", "echo {meta.iface"},
+		{"echo {meta.{meta.iface}}", "echo {meta.wg0}"},
+		{"echo {domain} {tag}", "echo {domain} {tag}"},
+	}
+
+	for _, test := range tests {
+		if got := replaceMeta(test.command, meta); got != test.want {
+			t.Errorf("%q: got %q, want %q", test.command, got, test.want)
+		}
+	}
+
+	// Rule without metadata
+	if got := replaceMeta("echo {meta.iface}", nil); got != "echo " {
+		t.Errorf("without metadata: got %q", got)
+	}
+}
+
+func TestTriggerEventCommandMeta(t *testing.T) {
+	if !hasShell {
+		t.Skip("shell not found")
+	}
+
+	output := filepath.Join(t.TempDir(), "output")
+
+	conf := &config.Config{Trigger: &config.ConfigTrigger{}}
+	cmdConf := &config.ConfigTriggerCommand{
+		EventTemplate: "echo {tag} {domain} {type} {ip} {meta.iface} {meta.table} >> " + output,
+	}
+
+	rule, err := rules.NewRule("route-vpn", "+.netflix.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rule.Meta = map[string]string{"iface": "wg0", "table": "100"}
+
+	err = TriggerEventCommand(conf, cmdConf, rule, "www.netflix.test", []string{"www.netflix.test"}, []string{"10.0.0.1", "10.0.0.2"}, nil, "127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := "route-vpn www.netflix.test A 10.0.0.1 wg0 100\n" +
+		"route-vpn www.netflix.test A 10.0.0.2 wg0 100\n"
+	if string(data) != want {
+		t.Errorf("output = %q, want %q", data, want)
+	}
+	if strings.Contains(string(data), "{meta.") {
+		t.Errorf("placeholder left in %q", data)
+	}
+}
@@ -21,4 +21,6 @@ const (
 	OnStop         = "stop"
 	OnPartialStart = "partial_start"
 	OnPartialStop  = "partial_stop"
+	OnUpstreamDown = "upstream_down"
+	OnUpstreamUp   = "upstream_up"
 )
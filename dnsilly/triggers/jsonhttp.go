@@ -26,18 +26,24 @@ import (
 )
 
 type TriggerEventPayload struct {
-	Tag      string   `json:"tag"`
-	Domain   string   `json:"domain"`
-	Ipv4     []string `json:"ipv4"`
-	Ipv6     []string `json:"ipv6"`
-	ClientIP string   `json:"client_ip"`
+	Tag      string            `json:"tag"`
+	Domain   string            `json:"domain"`
+	Chain    []string          `json:"chain"`
+	Ipv4     []string          `json:"ipv4"`
+	Ipv6     []string          `json:"ipv6"`
+	ClientIP string            `json:"client_ip"`
+	Meta     map[string]string `json:"meta"`
+
+	// Set if unicode forms are enabled
+	DomainUnicode string `json:"domain_unicode,omitempty"`
 }
 
 type TriggerLifecyclePayload struct {
-	State string `json:"state"`
+	State    string `json:"state"`
+	Upstream string `json:"upstream,omitempty"`
 }
 
-func TriggerEventJSONHTTP(conf *config.Config, jhConf *config.ConfigTriggerJSONHTTP, rule *rules.Rule, domain string, ipv4 []string, ipv6 []string, client_ip string) error {
+func TriggerEventJSONHTTP(conf *config.Config, jhConf *config.ConfigTriggerJSONHTTP, rule *rules.Rule, domain string, chain []string, ipv4 []string, ipv6 []string, client_ip string) error {
 	if jhConf.EventEndpoint == "" {
 		return nil
 	}
@@ -45,9 +51,17 @@ func TriggerEventJSONHTTP(conf *config.Config, jhConf *config.ConfigTriggerJSONH
 	payload := TriggerEventPayload{
 		Tag:      rule.Tag,
 		Domain:   domain,
+		Chain:    chain,
 		Ipv4:     ipv4,
 		Ipv6:     ipv6,
 		ClientIP: client_ip,
+		Meta:     rule.Meta,
+	}
+	if payload.Meta == nil {
+		payload.Meta = make(map[string]string)
+	}
+	if conf.Trigger.Unicode {
+		payload.DomainUnicode = unicodeDomain(domain)
 	}
 	payloadBytes, _ := json.Marshal(payload)
 
@@ -67,13 +81,14 @@ func TriggerEventJSONHTTP(conf *config.Config, jhConf *config.ConfigTriggerJSONH
 	return nil
 }
 
-func TriggerLifecycleJSONHTTP(conf *config.Config, jhConf *config.ConfigTriggerJSONHTTP, state string) error {
+func TriggerLifecycleJSONHTTP(conf *config.Config, jhConf *config.ConfigTriggerJSONHTTP, state string, upstream string) error {
 	if jhConf.LifecycleEndpoint == "" {
 		return nil
 	}
 
 	payload := TriggerLifecyclePayload{
-		State: state,
+		State:    state,
+		Upstream: upstream,
 	}
 	payloadBytes, _ := json.Marshal(payload)
 
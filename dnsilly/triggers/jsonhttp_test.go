@@ -0,0 +1,83 @@
+// dnsilly - dns automation utility
+// Copyright (C) 2025  bitrate16 (bitrate16@gmail.com)
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package triggers
+
+import (
+	"dnsilly/config"
+	"dnsilly/rules"
+	"encoding/json"
+	"io"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTriggerEventJSONHTTPMeta(t *testing.T) {
+	tests := []struct {
+		name string
+		meta map[string]string
+		want string
+	}{
+		{name: "with metadata", meta: map[string]string{"iface": "wg0", "table": "100"}, want: `{"iface":"wg0","table":"100"}`},
+		{name: "without metadata", want: `{}`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var body []byte
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, _ = io.ReadAll(r.Body)
+			}))
+			defer server.Close()
+
+			rule, err := rules.NewRule("route-vpn", "+.netflix.test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			rule.Meta = test.meta
+
+			conf := &config.Config{Trigger: &config.ConfigTrigger{}}
+			jhConf := &config.ConfigTriggerJSONHTTP{EventEndpoint: server.URL}
+
+			err = TriggerEventJSONHTTP(conf, jhConf, rule, "www.netflix.test", []string{"www.netflix.test"}, []string{"10.0.0.1"}, nil, "127.0.0.1")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Metadata is always an object
+			raw := map[string]json.RawMessage{}
+			if err := json.Unmarshal(body, &raw); err != nil {
+				t.Fatalf("payload %s: %v", body, err)
+			}
+			if string(raw["meta"]) != test.want {
+				t.Errorf("meta = %s, want %s", raw["meta"], test.want)
+			}
+
+			payload := TriggerEventPayload{}
+			if err := json.Unmarshal(body, &payload); err != nil {
+				t.Fatal(err)
+			}
+			if payload.Tag != "route-vpn" || payload.Domain != "www.netflix.test" || payload.ClientIP != "127.0.0.1" {
+				t.Errorf("payload = %+v", payload)
+			}
+			if len(test.meta) != 0 && !maps.Equal(payload.Meta, test.meta) {
+				t.Errorf("meta = %v, want %v", payload.Meta, test.meta)
+			}
+		})
+	}
+}
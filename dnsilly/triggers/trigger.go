@@ -21,9 +21,21 @@ import (
 	"dnsilly/rules"
 	"dnsilly/util"
 	"fmt"
+
+	"golang.org/x/net/idna"
 )
 
-func TriggerEvent(conf *config.Config, rule *rules.Rule, domain string, ipv4 []string, ipv6 []string, client_ip string) {
+// Unicode form of punycode domain, ascii form if conversion fails
+func unicodeDomain(domain string) string {
+	unicode, err := idna.ToUnicode(domain)
+	if err != nil {
+		return domain
+	}
+
+	return unicode
+}
+
+func TriggerEvent(conf *config.Config, rule *rules.Rule, domain string, chain []string, ipv4 []string, ipv6 []string, client_ip string) {
 	if conf.Verbose {
 		fmt.Printf("[%s] Trigger event: domain=%s, rule=%s\n", util.Now(), domain, rule.Tag)
 	}
@@ -35,13 +47,13 @@ func TriggerEvent(conf *config.Config, rule *rules.Rule, domain string, ipv4 []s
 	for _, cmdConf := range conf.Trigger.Command {
 		if cmdConf.Async {
 			go func() {
-				err := TriggerEventCommand(conf, cmdConf, rule, domain, ipv4, ipv6, client_ip)
+				err := TriggerEventCommand(conf, cmdConf, rule, domain, chain, ipv4, ipv6, client_ip)
 				if err != nil {
 					fmt.Printf("[%s] Trigger event command error: %v\n", util.Now(), err)
 				}
 			}()
 		} else {
-			err := TriggerEventCommand(conf, cmdConf, rule, domain, ipv4, ipv6, client_ip)
+			err := TriggerEventCommand(conf, cmdConf, rule, domain, chain, ipv4, ipv6, client_ip)
 			if err != nil {
 				fmt.Printf("[%s] Trigger event command error: %v\n", util.Now(), err)
 			}
@@ -51,13 +63,13 @@ func TriggerEvent(conf *config.Config, rule *rules.Rule, domain string, ipv4 []s
 	for _, jhConf := range conf.Trigger.JSONHTTP {
 		if jhConf.Async {
 			go func() {
-				err := TriggerEventJSONHTTP(conf, jhConf, rule, domain, ipv4, ipv6, client_ip)
+				err := TriggerEventJSONHTTP(conf, jhConf, rule, domain, chain, ipv4, ipv6, client_ip)
 				if err != nil {
 					fmt.Printf("[%s] Trigger event json http error: %v\n", util.Now(), err)
 				}
 			}()
 		} else {
-			err := TriggerEventJSONHTTP(conf, jhConf, rule, domain, ipv4, ipv6, client_ip)
+			err := TriggerEventJSONHTTP(conf, jhConf, rule, domain, chain, ipv4, ipv6, client_ip)
 			if err != nil {
 				fmt.Printf("[%s] Trigger event json http error: %v\n", util.Now(), err)
 			}
@@ -70,6 +82,19 @@ func TriggerLifecycle(conf *config.Config, state string) {
 		fmt.Printf("[%s] Trigger lifecycle state: %s\n", util.Now(), state)
 	}
 
+	triggerLifecycle(conf, state, "")
+}
+
+// Trigger upstream_down or upstream_up lifecycle state
+func TriggerUpstream(conf *config.Config, state string, upstream string) {
+	if conf.Verbose {
+		fmt.Printf("[%s] Trigger lifecycle state: %s, upstream=%s\n", util.Now(), state, upstream)
+	}
+
+	triggerLifecycle(conf, state, upstream)
+}
+
+func triggerLifecycle(conf *config.Config, state string, upstream string) {
 	if conf.Trigger == nil {
 		return
 	}
@@ -77,13 +102,13 @@ func TriggerLifecycle(conf *config.Config, state string) {
 	for _, cmdConf := range conf.Trigger.Command {
 		if cmdConf.Async {
 			go func() {
-				err := TriggerLifecycleCommand(conf, cmdConf, state)
+				err := TriggerLifecycleCommand(conf, cmdConf, state, upstream)
 				if err != nil {
 					fmt.Printf("[%s] Trigger lifecycle command error: %v\n", util.Now(), err)
 				}
 			}()
 		} else {
-			err := TriggerLifecycleCommand(conf, cmdConf, state)
+			err := TriggerLifecycleCommand(conf, cmdConf, state, upstream)
 			if err != nil {
 				fmt.Printf("[%s] Trigger lifecycle command error: %v\n", util.Now(), err)
 			}
@@ -93,13 +118,13 @@ func TriggerLifecycle(conf *config.Config, state string) {
 	for _, jhConf := range conf.Trigger.JSONHTTP {
 		if jhConf.Async {
 			go func() {
-				err := TriggerLifecycleJSONHTTP(conf, jhConf, state)
+				err := TriggerLifecycleJSONHTTP(conf, jhConf, state, upstream)
 				if err != nil {
 					fmt.Printf("[%s] Trigger lifecycle json http error: %v\n", util.Now(), err)
 				}
 			}()
 		} else {
-			err := TriggerLifecycleJSONHTTP(conf, jhConf, state)
+			err := TriggerLifecycleJSONHTTP(conf, jhConf, state, upstream)
 			if err != nil {
 				fmt.Printf("[%s] Trigger lifecycle json http error: %v\n", util.Now(), err)
 			}
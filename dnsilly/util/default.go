@@ -30,6 +30,12 @@ func SetDefaults(v interface{}) {
 		field := val.Field(i)
 		tag := typ.Field(i).Tag.Get("default")
 
+		// Nested config sections
+		if field.Kind() == reflect.Ptr && !field.IsNil() && field.Elem().Kind() == reflect.Struct {
+			SetDefaults(field.Interface())
+			continue
+		}
+
 		if tag != "" && field.IsZero() {
 			switch field.Kind() {
 			case reflect.String:
@@ -29,3 +29,19 @@ func GetFileModificationTime(path string) (time.Time, error) {
 
 	return info.ModTime(), nil
 }
+
+// Modification times of files in same order, missing files get zero time
+func GetFilesModificationTimes(paths []string) ([]time.Time, error) {
+	times := make([]time.Time, len(paths))
+
+	var firstErr error
+	for i, path := range paths {
+		modTime, err := GetFileModificationTime(path)
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+		times[i] = modTime
+	}
+
+	return times, firstErr
+}